@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrInvalidAccountToken is returned for an account token that is unknown,
+// expired or already used
+var ErrInvalidAccountToken = errors.New("invalid or expired account token")
+
+// invalidLinkMessage is shown when an emailed link can't be used
+const invalidLinkMessage = "This link is invalid or has expired."
+
+// randomToken returns a 256-bit secret, URL-safe
+func randomToken() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// hashToken returns the form secret tokens are stored in
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueAccountToken creates a token for the user and returns the secret to
+// email them. Earlier unused tokens for the same purpose stop working, so
+// only the most recent email's link is valid.
+func issueAccountToken(tx *gorm.DB, userID, purpose string, ttl time.Duration) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = tx.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&AccountToken{}).
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose).
+			Update("used_at", time.Now()).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&AccountToken{
+			ID:        uuid.New().String(),
+			UserID:    userID,
+			Purpose:   purpose,
+			TokenHash: hashToken(token),
+			ExpiresAt: time.Now().Add(ttl),
+		}).Error
+	})
+	return token, err
+}
+
+// recentAccountToken reports whether a token for the purpose was issued to
+// the user within interval, to limit how often emails can be triggered
+func recentAccountToken(userID, purpose string, interval time.Duration) (bool, error) {
+	var count int64
+	err := DB.Model(&AccountToken{}).
+		Where("user_id = ? AND purpose = ? AND created_at > ?", userID, purpose, time.Now().Add(-interval)).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// findAccountToken looks up a live token without using it
+func findAccountToken(db *gorm.DB, token, purpose string) (*AccountToken, error) {
+	var accountToken AccountToken
+	err := db.Where("token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?",
+		hashToken(token), purpose, time.Now()).
+		First(&accountToken).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidAccountToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &accountToken, nil
+}
+
+// redeemAccountToken marks a live token used and returns it. The row is
+// locked so the token cannot be redeemed twice concurrently; call it inside
+// the transaction that acts on it.
+func redeemAccountToken(tx *gorm.DB, token, purpose string) (*AccountToken, error) {
+	accountToken, err := findAccountToken(tx.Clauses(clause.Locking{Strength: "UPDATE"}), token, purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if err := tx.Model(accountToken).Update("used_at", &now).Error; err != nil {
+		return nil, err
+	}
+	return accountToken, nil
+}
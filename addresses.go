@@ -0,0 +1,565 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// countryRule describes which address fields a country uses and how they
+// are validated
+type countryRule struct {
+	Name           string
+	RegionLabel    string // "" when addresses have no region
+	RegionRequired bool
+	Regions        string // allowed region codes, space separated; "" accepts any
+	PostalLabel    string
+	PostalRequired bool
+	PostalPattern  *regexp.Regexp
+	PostalFirst    bool // postal code is written before the city
+}
+
+// countryRules lists the countries we ship to, keyed by ISO 3166-1 alpha-2 code
+var countryRules = map[string]countryRule{
+	"US": {
+		Name:           "United States",
+		RegionLabel:    "State",
+		RegionRequired: true,
+		Regions: "AL AK AZ AR CA CO CT DE DC FL GA HI ID IL IN IA KS KY LA ME MD MA MI MN MS MO MT NE NV NH NJ NM NY " +
+			"NC ND OH OK OR PA PR RI SC SD TN TX UT VT VA WA WV WI WY",
+		PostalLabel:    "ZIP code",
+		PostalRequired: true,
+		PostalPattern:  regexp.MustCompile(`^\d{5}(-\d{4})?$`),
+	},
+	"CA": {
+		Name:           "Canada",
+		RegionLabel:    "Province",
+		RegionRequired: true,
+		Regions:        "AB BC MB NB NL NS NT NU ON PE QC SK YT",
+		PostalLabel:    "Postal code",
+		PostalRequired: true,
+		PostalPattern:  regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`),
+	},
+	"GB": {
+		Name:           "United Kingdom",
+		RegionLabel:    "County",
+		PostalLabel:    "Postcode",
+		PostalRequired: true,
+		PostalPattern:  regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`),
+	},
+	"IE": {
+		Name:          "Ireland",
+		RegionLabel:   "County",
+		PostalLabel:   "Eircode",
+		PostalPattern: regexp.MustCompile(`^[A-Z]\d[\dW] ?[A-Z\d]{4}$`),
+	},
+	"AU": {
+		Name:           "Australia",
+		RegionLabel:    "State",
+		RegionRequired: true,
+		Regions:        "ACT NSW NT QLD SA TAS VIC WA",
+		PostalLabel:    "Postcode",
+		PostalRequired: true,
+		PostalPattern:  regexp.MustCompile(`^\d{4}$`),
+	},
+	"DE": {
+		Name:           "Germany",
+		PostalLabel:    "Postleitzahl",
+		PostalRequired: true,
+		PostalPattern:  regexp.MustCompile(`^\d{5}$`),
+		PostalFirst:    true,
+	},
+	"FR": {
+		Name:           "France",
+		PostalLabel:    "Code postal",
+		PostalRequired: true,
+		PostalPattern:  regexp.MustCompile(`^\d{5}$`),
+		PostalFirst:    true,
+	},
+}
+
+// shippingCountries is the order countries appear in address forms
+var shippingCountries = []string{"US", "CA", "GB", "IE", "AU", "DE", "FR"}
+
+// countryOption is a country as offered in address forms
+type countryOption struct {
+	Code        string
+	Name        string
+	RegionLabel string
+	PostalLabel string
+}
+
+// countryOptions returns the shipping countries for address form selects
+func countryOptions() []countryOption {
+	options := make([]countryOption, 0, len(shippingCountries))
+	for _, code := range shippingCountries {
+		rule := countryRules[code]
+		options = append(options, countryOption{
+			Code:        code,
+			Name:        rule.Name,
+			RegionLabel: rule.RegionLabel,
+			PostalLabel: rule.PostalLabel,
+		})
+	}
+	return options
+}
+
+// maxAddressFieldLength bounds every address field
+const maxAddressFieldLength = 100
+
+var phonePattern = regexp.MustCompile(`^\+?[\d ().-]{6,20}$`)
+
+// validate normalizes whitespace and letter case, then checks the address
+// against the rules for its country
+func (a *PostalAddress) validate() error {
+	for _, field := range []*string{&a.FullName, &a.Line1, &a.Line2, &a.City, &a.Region, &a.PostalCode, &a.Country, &a.Phone} {
+		*field = strings.Join(strings.Fields(*field), " ")
+		if len(*field) > maxAddressFieldLength {
+			return fmt.Errorf("Address fields must be at most %d characters", maxAddressFieldLength)
+		}
+	}
+	a.Country = strings.ToUpper(a.Country)
+	a.PostalCode = strings.ToUpper(a.PostalCode)
+
+	rule, ok := countryRules[a.Country]
+	if !ok {
+		return errors.New("We don't ship to that country yet")
+	}
+	if a.FullName == "" {
+		return errors.New("Full name is required")
+	}
+	if a.Line1 == "" {
+		return errors.New("Street address is required")
+	}
+	if a.City == "" {
+		return errors.New("City is required")
+	}
+
+	switch {
+	case rule.RegionLabel == "":
+		a.Region = ""
+	case a.Region == "":
+		if rule.RegionRequired {
+			return fmt.Errorf("%s is required", rule.RegionLabel)
+		}
+	case rule.Regions != "":
+		a.Region = strings.ToUpper(a.Region)
+		if !strings.Contains(" "+rule.Regions+" ", " "+a.Region+" ") {
+			return fmt.Errorf("%s must be a %s code such as %s", rule.RegionLabel, strings.ToLower(rule.RegionLabel), strings.Fields(rule.Regions)[0])
+		}
+	}
+
+	switch {
+	case a.PostalCode == "":
+		if rule.PostalRequired {
+			return fmt.Errorf("%s is required", rule.PostalLabel)
+		}
+	case !rule.PostalPattern.MatchString(a.PostalCode):
+		return fmt.Errorf("%s is not valid for %s", rule.PostalLabel, rule.Name)
+	}
+
+	if a.Phone != "" && !phonePattern.MatchString(a.Phone) {
+		return errors.New("Phone number is not valid")
+	}
+	return nil
+}
+
+// IsZero reports whether no address was recorded, as on orders placed
+// before checkout collected one
+func (a PostalAddress) IsZero() bool {
+	return a == PostalAddress{}
+}
+
+// CountryName returns the country's display name
+func (a PostalAddress) CountryName() string {
+	if rule, ok := countryRules[a.Country]; ok {
+		return rule.Name
+	}
+	return a.Country
+}
+
+// Lines formats the address for display in the country's usual order
+func (a PostalAddress) Lines() []string {
+	lines := []string{a.FullName, a.Line1}
+	if a.Line2 != "" {
+		lines = append(lines, a.Line2)
+	}
+
+	if countryRules[a.Country].PostalFirst {
+		lines = append(lines, strings.TrimSpace(a.PostalCode+" "+a.City))
+	} else {
+		locality := a.City
+		if tail := strings.TrimSpace(a.Region + " " + a.PostalCode); tail != "" {
+			locality += ", " + tail
+		}
+		lines = append(lines, locality)
+	}
+
+	return append(lines, a.CountryName())
+}
+
+// Summary is a one-line form of the address for pickers
+func (a PostalAddress) Summary() string {
+	return strings.Join(a.Lines(), ", ")
+}
+
+// postalAddressFromForm reads an address from an HTML form submission
+func postalAddressFromForm(r *http.Request) PostalAddress {
+	return PostalAddress{
+		FullName:   r.FormValue("full_name"),
+		Line1:      r.FormValue("line1"),
+		Line2:      r.FormValue("line2"),
+		City:       r.FormValue("city"),
+		Region:     r.FormValue("region"),
+		PostalCode: r.FormValue("postal_code"),
+		Country:    r.FormValue("country"),
+		Phone:      r.FormValue("phone"),
+	}
+}
+
+// listAddresses returns the user's address book, default first
+func listAddresses(userID string) ([]Address, error) {
+	var addresses []Address
+	err := DB.Where("user_id = ?", userID).Order("is_default DESC, created_at DESC").Find(&addresses).Error
+	return addresses, err
+}
+
+// findAddress loads one of the user's addresses
+func findAddress(userID, addressID string) (*Address, error) {
+	var address Address
+	if err := DB.Where("id = ? AND user_id = ?", addressID, userID).First(&address).Error; err != nil {
+		return nil, err
+	}
+	return &address, nil
+}
+
+// defaultAddress returns the user's default address, if they have one
+func defaultAddress(userID string) (PostalAddress, bool) {
+	var address Address
+	if err := DB.Where("user_id = ? AND is_default = ?", userID, true).First(&address).Error; err != nil {
+		return PostalAddress{}, false
+	}
+	return address.PostalAddress, true
+}
+
+// saveAddress creates or updates an address book entry. A user's first
+// address becomes their default; makeDefault moves the default to this one.
+func saveAddress(address *Address, makeDefault bool) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var otherDefaults int64
+		err := tx.Model(&Address{}).
+			Where("user_id = ? AND is_default AND id <> ?", address.UserID, address.ID).
+			Count(&otherDefaults).Error
+		if err != nil {
+			return err
+		}
+
+		if makeDefault && otherDefaults > 0 {
+			err := tx.Model(&Address{}).
+				Where("user_id = ? AND id <> ?", address.UserID, address.ID).
+				Update("is_default", false).Error
+			if err != nil {
+				return err
+			}
+		}
+		address.IsDefault = address.IsDefault || makeDefault || otherDefaults == 0
+
+		if address.ID == "" {
+			address.ID = uuid.New().String()
+			return tx.Create(address).Error
+		}
+		return tx.Save(address).Error
+	})
+}
+
+// setDefaultAddress makes one of the user's addresses their default
+func setDefaultAddress(userID, addressID string) error {
+	address, err := findAddress(userID, addressID)
+	if err != nil {
+		return err
+	}
+	return saveAddress(address, true)
+}
+
+// deleteAddress removes one of the user's addresses. If it was the default,
+// their most recently added remaining address takes over.
+func deleteAddress(userID, addressID string) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var address Address
+		if err := tx.Where("id = ? AND user_id = ?", addressID, userID).First(&address).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&address).Error; err != nil {
+			return err
+		}
+		if !address.IsDefault {
+			return nil
+		}
+		return tx.Model(&Address{}).
+			Where("id = (SELECT id FROM addresses WHERE user_id = ? ORDER BY created_at DESC LIMIT 1)", userID).
+			Update("is_default", true).Error
+	})
+}
+
+// checkoutAddress resolves where an order ships: one of the user's saved
+// addresses by ID, or an address entered at checkout
+func checkoutAddress(userID, addressID string, entered *PostalAddress) (PostalAddress, error) {
+	var shipTo PostalAddress
+	switch {
+	case addressID != "":
+		address, err := findAddress(userID, addressID)
+		if err != nil {
+			return shipTo, errors.New("Choose a shipping address")
+		}
+		shipTo = address.PostalAddress
+	case entered != nil:
+		shipTo = *entered
+	default:
+		return shipTo, errors.New("A shipping address is required")
+	}
+
+	// Saved addresses are checked again in case the rules have changed
+	return shipTo, shipTo.validate()
+}
+
+// renderAddressBook renders the address book page with an add/edit form
+func renderAddressBook(w http.ResponseWriter, r *http.Request, user *User, form Address, formErr string) {
+	tmpl, err := template.ParseFiles("templates/addresses.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Template error: %v", err)
+		return
+	}
+
+	addresses, err := listAddresses(user.ID)
+	if err != nil {
+		log.Printf("Failed to load addresses: %v", err)
+		http.Error(w, "Failed to load addresses", http.StatusInternalServerError)
+		return
+	}
+
+	if form.Country == "" {
+		form.Country = shippingCountries[0]
+	}
+
+	data := map[string]interface{}{
+		"Addresses": addresses,
+		"Form":      form,
+		"IsNew":     form.ID == "",
+		"Countries": countryOptions(),
+		"Notice":    r.URL.Query().Get("notice"),
+		"Error":     formErr,
+		"User":      user,
+	}
+
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("Template execution error: %v", err)
+	}
+}
+
+// addressesHandler shows the address book and saves the add/edit form
+func addressesHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := getCurrentUser(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	var form Address
+	if addressID := r.FormValue("id"); addressID != "" {
+		address, err := findAddress(user.ID, addressID)
+		if err != nil {
+			http.Error(w, "Address not found", http.StatusNotFound)
+			return
+		}
+		form = *address
+	}
+
+	if r.Method == http.MethodGet {
+		renderAddressBook(w, r, user, form, "")
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	form.UserID = user.ID
+	form.PostalAddress = postalAddressFromForm(r)
+	if err := form.PostalAddress.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		renderAddressBook(w, r, user, form, err.Error())
+		return
+	}
+
+	if err := saveAddress(&form, r.FormValue("is_default") == "on"); err != nil {
+		log.Printf("Failed to save address: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		renderAddressBook(w, r, user, form, "Failed to save address")
+		return
+	}
+
+	http.Redirect(w, r, "/addresses?notice="+url.QueryEscape("Address saved"), http.StatusSeeOther)
+}
+
+// deleteAddressHandler removes an address from the address book
+func deleteAddressHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := getCurrentUser(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := deleteAddress(user.ID, r.FormValue("id")); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Address not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to delete address: %v", err)
+		http.Error(w, "Failed to delete address", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/addresses?notice="+url.QueryEscape("Address removed"), http.StatusSeeOther)
+}
+
+// defaultAddressHandler makes an address the user's default
+func defaultAddressHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := getCurrentUser(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := setDefaultAddress(user.ID, r.FormValue("id")); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Address not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to set default address: %v", err)
+		http.Error(w, "Failed to update address", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/addresses?notice="+url.QueryEscape("Default address updated"), http.StatusSeeOther)
+}
+
+// addressInput is the JSON body for creating or updating an address
+type addressInput struct {
+	PostalAddress
+	IsDefault bool `json:"is_default"`
+}
+
+// addressesAPIHandler manages the current user's address book as JSON:
+//
+//	GET    /api/addresses          list addresses
+//	GET    /api/addresses?id=X     one address
+//	POST   /api/addresses          add an address
+//	PUT    /api/addresses?id=X     replace an address
+//	DELETE /api/addresses?id=X     remove an address
+func addressesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, err := getCurrentUser(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+		return
+	}
+
+	addressID := r.URL.Query().Get("id")
+	address := &Address{UserID: user.ID}
+	if addressID != "" {
+		if address, err = findAddress(user.ID, addressID); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Address not found"})
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if addressID != "" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"address": address})
+			return
+		}
+
+		addresses, err := listAddresses(user.ID)
+		if err != nil {
+			log.Printf("Failed to load addresses: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load addresses"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"addresses": addresses})
+
+	case http.MethodPost, http.MethodPut:
+		if r.Method == http.MethodPut && addressID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Address id is required"})
+			return
+		}
+
+		var in addressInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+			return
+		}
+		if err := in.PostalAddress.validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		address.PostalAddress = in.PostalAddress
+
+		if err := saveAddress(address, in.IsDefault); err != nil {
+			log.Printf("Failed to save address: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save address"})
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "address": address})
+
+	case http.MethodDelete:
+		if addressID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Address id is required"})
+			return
+		}
+		if err := deleteAddress(user.ID, addressID); err != nil {
+			log.Printf("Failed to delete address: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to delete address"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+	}
+}
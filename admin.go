@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// productInput is the editable subset of a Product, shared by the admin
+// HTML forms and the JSON API
+type productInput struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	PriceCents  int64    `json:"price_cents"`
+	ImageURL    string   `json:"image_url"`
+	Stock       int      `json:"stock"`
+	StockSeen   *int     `json:"stock_seen"` // stock the editor started from, if known
+	WeightGrams int      `json:"weight_grams"`
+	TaxCategory string   `json:"tax_category"`
+	CategoryID  string   `json:"category_id"`
+	Tags        []string `json:"tags"`
+}
+
+// validate checks the input and normalizes whitespace
+func (in *productInput) validate() error {
+	in.Name = strings.TrimSpace(in.Name)
+	in.Description = strings.TrimSpace(in.Description)
+	in.ImageURL = strings.TrimSpace(in.ImageURL)
+
+	if in.Name == "" {
+		return errors.New("Name is required")
+	}
+	if in.PriceCents <= 0 {
+		return errors.New("Price must be greater than zero")
+	}
+	if in.Stock < 0 {
+		return errors.New("Stock cannot be negative")
+	}
+	if in.WeightGrams < 0 {
+		return errors.New("Weight cannot be negative")
+	}
+	if in.TaxCategory == "" {
+		in.TaxCategory = TaxStandard
+	}
+	if !validTaxCategory(in.TaxCategory) {
+		return errors.New("Tax category must be standard, reduced or exempt")
+	}
+	if in.ImageURL != "" && !strings.HasPrefix(in.ImageURL, "https://") && !strings.HasPrefix(in.ImageURL, "http://") {
+		return errors.New("Image URL must start with http:// or https://")
+	}
+	if in.CategoryID != "" {
+		var count int64
+		DB.Model(&Category{}).Where("id = ?", in.CategoryID).Count(&count)
+		if count == 0 {
+			return errors.New("Unknown category")
+		}
+	}
+	return nil
+}
+
+// apply copies the input onto a product
+func (in productInput) apply(p *Product) {
+	p.Name = in.Name
+	p.Description = in.Description
+	p.Price = in.PriceCents
+	p.ImageURL = in.ImageURL
+	p.Stock = in.Stock
+	p.WeightGrams = in.WeightGrams
+	p.TaxCategory = in.TaxCategory
+	p.CategoryID = nil
+	if in.CategoryID != "" {
+		categoryID := in.CategoryID
+		p.CategoryID = &categoryID
+	}
+}
+
+// stockChange returns how far the input moves a product's stock, measured
+// from the stock the editor started from rather than the current one, so
+// units sold while the product was being edited stay sold. Without
+// StockSeen it is measured from loaded, the stock read for this request.
+func (in productInput) stockChange(loaded int) int {
+	seen := loaded
+	if in.StockSeen != nil {
+		seen = *in.StockSeen
+	}
+	return in.Stock - seen
+}
+
+// saveProduct creates or updates a product and replaces its tags. An update
+// leaves the stored stock alone apart from adding stockChange, which keeps
+// checkouts that decrement it concurrently from being overwritten.
+func saveProduct(product *Product, tagNames []string, stockChange int, create bool) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if create {
+			product.ID = uuid.New().String()
+			err = tx.Omit("Category", "Tags", "Variants").Create(product).Error
+		} else {
+			err = tx.Omit("Category", "Tags", "Variants", "Stock").Save(product).Error
+			if err == nil && stockChange != 0 {
+				err = restock(tx, product.ID, nil, stockChange)
+			}
+			if err == nil {
+				err = tx.Model(&Product{}).Where("id = ?", product.ID).Pluck("stock", &product.Stock).Error
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		tags, err := findOrCreateTags(tx, tagNames)
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(product).Association("Tags").Replace(tags); err != nil {
+			return err
+		}
+		product.Tags = tags
+		return nil
+	})
+}
+
+// CategoryIDString returns the category ID, or "" when uncategorized
+func (p Product) CategoryIDString() string {
+	if p.CategoryID == nil {
+		return ""
+	}
+	return *p.CategoryID
+}
+
+// TagList renders a product's tags for the comma-separated form field
+func (p Product) TagList() string {
+	names := make([]string, 0, len(p.Tags))
+	for _, tag := range p.Tags {
+		names = append(names, tag.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// parsePriceCents converts a dollar amount like "12.99" into cents
+func parsePriceCents(s string) (int64, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "$")
+	dollars, err := strconv.ParseFloat(s, 64)
+	if err != nil || dollars < 0 {
+		return 0, fmt.Errorf("invalid price %q", s)
+	}
+	return int64(math.Round(dollars * 100)), nil
+}
+
+// productInputFromForm reads a productInput from an HTML form submission
+func productInputFromForm(r *http.Request) (productInput, error) {
+	in := productInput{
+		Name:        r.FormValue("name"),
+		Description: r.FormValue("description"),
+		ImageURL:    r.FormValue("image_url"),
+		CategoryID:  r.FormValue("category_id"),
+		TaxCategory: r.FormValue("tax_category"),
+		Tags:        strings.Split(r.FormValue("tags"), ","),
+	}
+
+	price, err := parsePriceCents(r.FormValue("price"))
+	if err != nil {
+		return in, errors.New("Price must be a dollar amount like 12.99")
+	}
+	in.PriceCents = price
+
+	if seen, err := strconv.Atoi(r.FormValue("stock_seen")); err == nil {
+		in.StockSeen = &seen
+	}
+	stock, err := strconv.Atoi(strings.TrimSpace(r.FormValue("stock")))
+	if err != nil {
+		return in, errors.New("Stock must be a whole number")
+	}
+	in.Stock = stock
+
+	// Weight is optional on the form; blank means unknown (0)
+	if weight := strings.TrimSpace(r.FormValue("weight_grams")); weight != "" {
+		grams, err := strconv.Atoi(weight)
+		if err != nil {
+			return in, errors.New("Weight must be a whole number of grams")
+		}
+		in.WeightGrams = grams
+	}
+
+	return in, in.validate()
+}
+
+// adminProductsHandler lists every product, including archived ones
+func adminProductsHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := getCurrentUser(r)
+
+	tmpl := template.New("admin-products.html").Funcs(template.FuncMap{
+		"divf": func(a, b int64) float64 {
+			return float64(a) / float64(b)
+		},
+	})
+
+	tmpl, err := tmpl.ParseFiles("templates/admin-products.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Template error: %v", err)
+		return
+	}
+
+	var products []Product
+	DB.Preload("Category").Preload("Tags").Preload("Variants", liveVariants).Order("archived_at IS NOT NULL, name").Find(&products)
+
+	data := map[string]interface{}{
+		"Products": products,
+		"User":     user,
+		"Notice":   r.URL.Query().Get("notice"),
+	}
+
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("Template execution error: %v", err)
+	}
+}
+
+// adminProductFormHandler renders and saves the create/edit product form.
+// An empty id creates a new product.
+func adminProductFormHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := getCurrentUser(r)
+	productID := r.FormValue("id")
+
+	var product Product
+	if productID != "" {
+		if err := DB.Preload("Tags").Preload("Variants", liveVariants).Where("id = ?", productID).First(&product).Error; err != nil {
+			http.Error(w, "Product not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	// The stock shown when the form was first opened, carried through
+	// resubmissions so the change is measured from it
+	stockSeen := product.Stock
+
+	renderForm := func(formErr string) {
+		tmpl := template.New("admin-product-form.html").Funcs(template.FuncMap{
+			"divf": func(a, b int64) float64 {
+				return float64(a) / float64(b)
+			},
+		})
+
+		tmpl, err := tmpl.ParseFiles("templates/admin-product-form.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Printf("Template error: %v", err)
+			return
+		}
+
+		data := map[string]interface{}{
+			"Product":       product,
+			"StockSeen":     stockSeen,
+			"Categories":    loadCategoryTree(),
+			"TaxCategories": taxCategories,
+			"IsNew":         productID == "",
+			"Error":         formErr,
+			"User":          user,
+		}
+
+		if err := tmpl.Execute(w, data); err != nil {
+			log.Printf("Template execution error: %v", err)
+		}
+	}
+
+	if r.Method == http.MethodGet {
+		renderForm("")
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	in, err := productInputFromForm(r)
+	if in.StockSeen != nil {
+		stockSeen = *in.StockSeen
+	}
+	stockChange := in.stockChange(product.Stock)
+	in.apply(&product)
+	if err != nil {
+		// Echo the submitted tags back into the form
+		product.Tags = nil
+		for _, name := range in.Tags {
+			if name = strings.TrimSpace(name); name != "" {
+				product.Tags = append(product.Tags, Tag{Name: name})
+			}
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		renderForm(err.Error())
+		return
+	}
+
+	if err := saveProduct(&product, in.Tags, stockChange, productID == ""); err != nil {
+		log.Printf("Failed to save product: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		renderForm("Failed to save product")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/products?notice="+url.QueryEscape("Saved "+product.Name), http.StatusSeeOther)
+}
+
+// adminArchiveProductHandler hides a product from the storefront, or restores
+// it when action=restore
+func adminArchiveProductHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var product Product
+	if err := DB.Where("id = ?", r.FormValue("id")).First(&product).Error; err != nil {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+
+	restore := r.FormValue("action") == "restore"
+	if err := setProductArchived(&product, !restore); err != nil {
+		log.Printf("Failed to archive product: %v", err)
+		http.Error(w, "Failed to update product", http.StatusInternalServerError)
+		return
+	}
+
+	notice := "Archived " + product.Name
+	if restore {
+		notice = "Restored " + product.Name
+	}
+	http.Redirect(w, r, "/admin/products?notice="+url.QueryEscape(notice), http.StatusSeeOther)
+}
+
+// setProductArchived archives or restores a product. Archiving also removes
+// the product from every cart so it can no longer be purchased.
+func setProductArchived(product *Product, archived bool) error {
+	if !archived {
+		return DB.Model(product).Update("archived_at", nil).Error
+	}
+
+	now := time.Now()
+	if err := DB.Model(product).Update("archived_at", &now).Error; err != nil {
+		return err
+	}
+	return DB.Where("product_id = ?", product.ID).Delete(&CartItem{}).Error
+}
+
+// adminProductsAPIHandler exposes product management as JSON:
+//
+//	GET    /api/admin/products        list products
+//	GET    /api/admin/products?id=X   fetch one product
+//	POST   /api/admin/products        create a product
+//	PUT    /api/admin/products?id=X   update a product
+//	DELETE /api/admin/products?id=X   archive a product
+func adminProductsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	productID := r.URL.Query().Get("id")
+
+	// Creating never targets an existing product; updates go through PUT
+	if r.Method == http.MethodPost && productID != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Product id is not allowed when creating; use PUT to update"})
+		return
+	}
+
+	var product Product
+	if productID != "" {
+		if err := DB.Preload("Category").Preload("Tags").Where("id = ?", productID).First(&product).Error; err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if productID != "" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"product": product})
+			return
+		}
+
+		var products []Product
+		query := DB.Preload("Category").Preload("Tags").Order("name")
+		if r.URL.Query().Get("include_archived") != "true" {
+			query = query.Where("archived_at IS NULL")
+		}
+		query.Find(&products)
+		json.NewEncoder(w).Encode(map[string]interface{}{"products": products})
+
+	case http.MethodPost, http.MethodPut:
+		if r.Method == http.MethodPut && productID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Product id is required"})
+			return
+		}
+
+		var in productInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+			return
+		}
+		if err := in.validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		stockChange := in.stockChange(product.Stock)
+		in.apply(&product)
+
+		status := http.StatusOK
+		if r.Method == http.MethodPost {
+			status = http.StatusCreated
+		}
+		if err := saveProduct(&product, in.Tags, stockChange, r.Method == http.MethodPost); err != nil {
+			log.Printf("Failed to save product: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save product"})
+			return
+		}
+
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "product": product})
+
+	case http.MethodDelete:
+		if productID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Product id is required"})
+			return
+		}
+		if err := setProductArchived(&product, true); err != nil {
+			log.Printf("Failed to archive product: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to archive product"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "product": product})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// adminOrderSummary is an order row in the staff order list
+type adminOrderSummary struct {
+	orderSummary
+	CustomerEmail string `json:"customer_email"`
+	Refunded      int64  `json:"refunded_cents"`
+}
+
+// CustomerEmail returns the email of the user who placed the order, when loaded
+func (o Order) CustomerEmail() string {
+	if o.User == nil {
+		return ""
+	}
+	return o.User.Email
+}
+
+// listAllOrders returns one page of every customer's orders, newest first,
+// optionally restricted to one status
+func listAllOrders(status string, page, perPage int) ([]Order, int64, error) {
+	query := DB.Model(&Order{})
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var orders []Order
+	err := query.Preload("User").Preload("Items").
+		Order("created_at DESC, id DESC").
+		Limit(perPage).
+		Offset((page - 1) * perPage).
+		Find(&orders).Error
+	return orders, total, err
+}
+
+// loadOrderForStaff fetches any order with everything the staff views show
+func loadOrderForStaff(orderID string) (*Order, error) {
+	var order Order
+	err := DB.Preload("User").
+		Preload("Items", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		Preload("Items.Product").
+		Preload("Refunds", func(db *gorm.DB) *gorm.DB { return db.Order("created_at DESC") }).
+		Preload("Refunds.Items").
+		Preload("StatusHistory", func(db *gorm.DB) *gorm.DB { return db.Order("created_at DESC, id DESC") }).
+		Where("id = ?", orderID).
+		First(&order).Error
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// adminOrdersHandler lists all orders for staff
+func adminOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := getCurrentUser(r)
+
+	tmpl := template.New("admin-orders.html").Funcs(template.FuncMap{
+		"divf": func(a, b int64) float64 {
+			return float64(a) / float64(b)
+		},
+	})
+
+	tmpl, err := tmpl.ParseFiles("templates/admin-orders.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Template error: %v", err)
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	page, perPage := pageParams(r, ordersPerPage, maxOrdersPerPage)
+	orders, total, err := listAllOrders(status, page, perPage)
+	if err != nil {
+		log.Printf("Failed to load orders: %v", err)
+		http.Error(w, "Failed to load orders", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Orders":   orders,
+		"Status":   status,
+		"Statuses": orderStatuses,
+		"Page":     page,
+		"Total":    total,
+		"HasPrev":  page > 1,
+		"HasNext":  int64(page*perPage) < total,
+		"PrevPage": page - 1,
+		"NextPage": page + 1,
+		"User":     user,
+	}
+
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("Template execution error: %v", err)
+	}
+}
+
+// adminOrderHandler shows one order to staff, with the refund form for users
+// allowed to issue refunds
+func adminOrderHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := getCurrentUser(r)
+
+	order, err := loadOrderForStaff(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	tmpl := template.New("admin-order.html").Funcs(template.FuncMap{
+		"divf": func(a, b int64) float64 {
+			return float64(a) / float64(b)
+		},
+	})
+
+	tmpl, err = tmpl.ParseFiles("templates/admin-order.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Template error: %v", err)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Order":     order,
+		"CanRefund": user.Can(PermRefundOrders) && order.PaymentStatus == PaymentStatusCompleted && order.RefundableAmount() > 0,
+		"CanManage": user.Can(PermManageOrders),
+		"Notice":    r.URL.Query().Get("notice"),
+		"Error":     r.URL.Query().Get("error"),
+		"User":      user,
+	}
+
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("Template execution error: %v", err)
+	}
+}
+
+// adminRefundOrderHandler issues a refund from the order page form. Each
+// line's quantity comes in a qty_<order item id> field; "full" refunds the
+// whole remaining balance instead.
+func adminRefundOrderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := getCurrentUser(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	orderID := r.FormValue("id")
+	req := RefundRequest{
+		Reason:  strings.TrimSpace(r.FormValue("reason")),
+		Restock: r.FormValue("restock") == "on",
+	}
+	if r.FormValue("full") == "" {
+		for key, values := range r.PostForm {
+			itemID, found := strings.CutPrefix(key, "qty_")
+			if !found {
+				continue
+			}
+			id, err := strconv.ParseUint(itemID, 10, 64)
+			quantity, qtyErr := strconv.Atoi(values[0])
+			if err != nil || qtyErr != nil || quantity == 0 {
+				continue
+			}
+			req.Lines = append(req.Lines, RefundLine{OrderItemID: uint(id), Quantity: quantity})
+		}
+		if len(req.Lines) == 0 {
+			http.Redirect(w, r, "/admin/orders/detail?id="+url.QueryEscape(orderID)+"&error="+url.QueryEscape("Select at least one item to refund"), http.StatusSeeOther)
+			return
+		}
+	}
+
+	refund, err := refundOrder(orderID, req, user)
+	if err != nil {
+		status, message := refundErrorResponse(err)
+		if status == http.StatusNotFound {
+			http.Error(w, message, status)
+			return
+		}
+		http.Redirect(w, r, "/admin/orders/detail?id="+url.QueryEscape(orderID)+"&error="+url.QueryEscape(message), http.StatusSeeOther)
+		return
+	}
+
+	notice := "Refunded $" + strconv.FormatFloat(float64(refund.Amount)/100, 'f', 2, 64)
+	http.Redirect(w, r, "/admin/orders/detail?id="+url.QueryEscape(orderID)+"&notice="+url.QueryEscape(notice), http.StatusSeeOther)
+}
+
+// adminOrderStatusHandler applies a fulfillment status change from the
+// order page form
+func adminOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := getCurrentUser(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	orderID := r.FormValue("id")
+	detailURL := "/admin/orders/detail?id=" + url.QueryEscape(orderID)
+
+	order, err := updateOrderStatus(orderID, r.FormValue("status"), user, strings.TrimSpace(r.FormValue("note")))
+	if err != nil {
+		status, message := statusErrorResponse(err)
+		if status == http.StatusNotFound {
+			http.Error(w, message, status)
+			return
+		}
+		http.Redirect(w, r, detailURL+"&error="+url.QueryEscape(message), http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(w, r, detailURL+"&notice="+url.QueryEscape("Order marked "+order.Status), http.StatusSeeOther)
+}
+
+// statusErrorResponse maps an updateOrderStatus error to a status code and message
+func statusErrorResponse(err error) (int, string) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound, "Order not found"
+	case errors.Is(err, ErrIllegalTransition):
+		return http.StatusConflict, "That status change is not allowed (" + strings.TrimPrefix(err.Error(), ErrIllegalTransition.Error()+": ") + ")"
+	default:
+		log.Printf("Failed to update order status: %v", err)
+		return http.StatusInternalServerError, "Failed to update order status"
+	}
+}
+
+// refundErrorResponse maps a refundOrder error to a status code and message
+func refundErrorResponse(err error) (int, string) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound, "Order not found"
+	case errors.Is(err, ErrInvalidRefund):
+		return http.StatusBadRequest, strings.TrimPrefix(err.Error(), ErrInvalidRefund.Error()+": ")
+	case errors.Is(err, ErrNotRefundable):
+		return http.StatusConflict, "This order's payment cannot be refunded"
+	default:
+		log.Printf("Refund failed: %v", err)
+		return http.StatusBadGateway, "The payment provider could not process the refund"
+	}
+}
+
+// adminOrdersAPIHandler exposes the staff order views as JSON:
+//
+//	GET /api/admin/orders?status=&page=&per_page=   list orders
+//	GET /api/admin/orders?id=X                      fetch one order with refunds
+func adminOrdersAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	if orderID := r.URL.Query().Get("id"); orderID != "" {
+		order, err := loadOrderForStaff(orderID)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Order not found"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"order":          order,
+			"customer_email": order.CustomerEmail(),
+		})
+		return
+	}
+
+	page, perPage := pageParams(r, ordersPerPage, maxOrdersPerPage)
+	orders, total, err := listAllOrders(r.URL.Query().Get("status"), page, perPage)
+	if err != nil {
+		log.Printf("Failed to load orders: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load orders"})
+		return
+	}
+
+	summaries := make([]adminOrderSummary, 0, len(orders))
+	for _, order := range orders {
+		summaries = append(summaries, adminOrderSummary{
+			orderSummary: orderSummary{
+				ID:        order.ID,
+				Status:    order.Status,
+				Total:     order.Total,
+				ItemCount: order.ItemCount(),
+				CreatedAt: order.CreatedAt,
+			},
+			CustomerEmail: order.CustomerEmail(),
+			Refunded:      order.RefundedAmount,
+		})
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"orders":      summaries,
+		"page":        page,
+		"per_page":    perPage,
+		"total_count": total,
+		"has_more":    int64(page*perPage) < total,
+	})
+}
+
+// adminOrderStatusAPIHandler applies a fulfillment status change as JSON:
+//
+//	POST /api/admin/orders/status?id=X {"status": "shipped", "note": "UPS 1Z..."}
+func adminOrderStatusAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	user, err := getCurrentUser(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Status string `json:"status"`
+		Note   string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+
+	order, err := updateOrderStatus(r.URL.Query().Get("id"), req.Status, user, strings.TrimSpace(req.Note))
+	if err != nil {
+		status, message := statusErrorResponse(err)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": message})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"order":   order,
+	})
+}
+
+// adminRefundOrderAPIHandler issues a refund as JSON:
+//
+//	POST /api/admin/orders/refund?id=X
+//	{"items": [{"order_item_id": 12, "quantity": 1}], "reason": "...", "restock": true}
+//
+// Omitting items refunds the order's whole remaining balance.
+func adminRefundOrderAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	user, err := getCurrentUser(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+		return
+	}
+
+	var req RefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+
+	orderID := r.URL.Query().Get("id")
+	refund, err := refundOrder(orderID, req, user)
+	if err != nil {
+		status, message := refundErrorResponse(err)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": message})
+		return
+	}
+
+	order, err := loadOrderForStaff(orderID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Refund issued but the order could not be reloaded"})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"refund":  refund,
+		"order":   order,
+	})
+}
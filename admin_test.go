@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+func TestSaveProductKeepsUnitsSoldWhileEditing(t *testing.T) {
+	useTestDatabase(t)
+	product := createTestProduct(t, Product{Name: "Laptop Stand", Price: 4900, Stock: 10})
+
+	// The editor opens the form at 10 units, three sell, and the editor
+	// saves 15 after receiving five more
+	if err := restock(DB, product.ID, nil, -3); err != nil {
+		t.Fatalf("sell units: %v", err)
+	}
+	seen := 10
+	in := productInput{Name: product.Name, PriceCents: 5400, Stock: 15, StockSeen: &seen}
+	if err := in.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+
+	var loaded Product
+	if err := DB.First(&loaded, "id = ?", product.ID).Error; err != nil {
+		t.Fatalf("load product: %v", err)
+	}
+	change := in.stockChange(loaded.Stock)
+	in.apply(&loaded)
+	if err := saveProduct(&loaded, nil, change, false); err != nil {
+		t.Fatalf("saveProduct: %v", err)
+	}
+
+	var saved Product
+	if err := DB.First(&saved, "id = ?", product.ID).Error; err != nil {
+		t.Fatalf("load product: %v", err)
+	}
+	if saved.Stock != 12 || loaded.Stock != 12 {
+		t.Errorf("stock = %d (returned %d), want 12", saved.Stock, loaded.Stock)
+	}
+	if saved.Price != 5400 {
+		t.Errorf("price = %d, want 5400", saved.Price)
+	}
+}
+
+func TestUpdateVariantKeepsUnitsSoldWhileEditing(t *testing.T) {
+	useTestDatabase(t)
+	product := createTestProduct(t, Product{Name: "Developer T-Shirt", Price: 2500})
+	variant := ProductVariant{ProductID: product.ID, SKU: "TEE-BLK-M", Options: map[string]string{"size": "M"}, Stock: 8}
+	if err := DB.Create(&variant).Error; err != nil {
+		t.Fatalf("create variant: %v", err)
+	}
+
+	// Loaded at 8 units, two sell before the edit that only changes the
+	// sort order is saved
+	in := variantInput{SKU: variant.SKU, Options: variant.Options, Stock: variant.Stock, SortOrder: 3}
+	if err := restock(DB, product.ID, &variant.ID, -2); err != nil {
+		t.Fatalf("sell units: %v", err)
+	}
+	change := in.stockChange(variant.Stock)
+	in.apply(&variant)
+	if err := updateVariant(&variant, change); err != nil {
+		t.Fatalf("updateVariant: %v", err)
+	}
+
+	var saved ProductVariant
+	if err := DB.First(&saved, "id = ?", variant.ID).Error; err != nil {
+		t.Fatalf("load variant: %v", err)
+	}
+	if saved.Stock != 6 || variant.Stock != 6 {
+		t.Errorf("stock = %d (returned %d), want 6", saved.Stock, variant.Stock)
+	}
+	if saved.SortOrder != 3 {
+		t.Errorf("sort order = %d, want 3", saved.SortOrder)
+	}
+}
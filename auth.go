@@ -3,7 +3,9 @@ package main
 import (
 	"encoding/json"
 	"html/template"
+	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -11,6 +13,7 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
 // JWT Claims structure
@@ -18,6 +21,7 @@ type Claims struct {
 	UserID string `json:"user_id"`
 	Email  string `json:"email"`
 	Name   string `json:"name"`
+	Role   string `json:"role"`
 	jwt.RegisteredClaims
 }
 
@@ -34,15 +38,19 @@ func CheckPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
-// GenerateJWT creates a new JWT token for a user
-func GenerateJWT(user *User) (string, error) {
-	expirationTime := time.Now().Add(7 * 24 * time.Hour) // 7 days
+// GenerateJWT creates a short-lived access token for a user's session. The
+// token is only accepted while that session is live; the session's refresh
+// token is used to get a new one when it expires (see sessions.go).
+func GenerateJWT(user *User, sessionID string) (string, time.Time, error) {
+	expirationTime := time.Now().Add(accessTokenTTL)
 
 	claims := &Claims{
 		UserID: user.ID,
 		Email:  user.Email,
 		Name:   user.Name,
+		Role:   user.Role,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        sessionID,
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Issuer:    "techstore",
@@ -52,28 +60,21 @@ func GenerateJWT(user *User) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
 	if err != nil {
-		return "", err
+		return "", time.Time{}, err
 	}
 
-	// Optionally store session in database for tracking/blacklisting
-	session := &Session{
-		ID:        uuid.New().String(),
-		UserID:    user.ID,
-		Token:     tokenString,
-		ExpiresAt: expirationTime,
-	}
-	DB.Create(session)
-
-	return tokenString, nil
+	return tokenString, expirationTime, nil
 }
 
-// ValidateJWT validates a JWT token and returns the claims
+// ValidateJWT validates a JWT token and returns the claims. Besides the
+// signature and expiry it requires the token's session to still be live, so
+// logged-out, revoked and refreshed tokens are rejected.
 func ValidateJWT(tokenString string) (*Claims, error) {
 	claims := &Claims{}
 
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
 		return []byte(os.Getenv("JWT_SECRET")), nil
-	})
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 
 	if err != nil {
 		return nil, err
@@ -83,6 +84,10 @@ func ValidateJWT(tokenString string) (*Claims, error) {
 		return nil, jwt.ErrSignatureInvalid
 	}
 
+	if err := checkSession(claims); err != nil {
+		return nil, err
+	}
+
 	return claims, nil
 }
 
@@ -119,18 +124,39 @@ func getCurrentUser(r *http.Request) (*User, error) {
 	return &user, nil
 }
 
+// isAPIRequest reports whether the client expects JSON rather than HTML
+func isAPIRequest(r *http.Request) bool {
+	return r.Header.Get("Content-Type") == "application/json" ||
+		strings.Contains(r.Header.Get("Accept"), "application/json") ||
+		strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+// localRedirectPath returns next if it is a path on this site, or "/".
+// Browsers read a backslash as a slash, so "/\evil.com" would leave the
+// site just like "//evil.com".
+func localRedirectPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.ContainsAny(next, "\\\r\n\t") {
+		return "/"
+	}
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return "/"
+	}
+	return next
+}
+
 // authMiddleware protects routes requiring authentication
 func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		_, err := getCurrentUser(r)
 		if err != nil {
 			// Check if it's an API request or browser request
-			if r.Header.Get("Content-Type") == "application/json" {
+			if isAPIRequest(r) {
 				w.WriteHeader(http.StatusUnauthorized)
 				json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
 				return
 			}
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
 			return
 		}
 
@@ -184,6 +210,7 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		Email:        req.Email,
 		PasswordHash: hashedPassword,
 		Name:         req.Name,
+		Role:         RoleCustomer,
 		CreatedAt:    time.Now(),
 	}
 
@@ -193,34 +220,37 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate JWT token
-	token, err := GenerateJWT(user)
+	// Start a session
+	tokens, err := startSession(user)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to generate token"})
 		return
 	}
 
-	// Set cookie for browser
-	http.SetCookie(w, &http.Cookie{
-		Name:     "auth_token",
-		Value:    token,
-		Expires:  time.Now().Add(7 * 24 * time.Hour),
-		HttpOnly: true,
-		Secure:   false, // Set to true in production with HTTPS
-		SameSite: http.SameSiteLaxMode,
-		Path:     "/",
-	})
+	// Set cookies for browser
+	setAuthCookies(w, tokens)
+
+	// Move anything added to the cart before signing up into the new account
+	mergeGuestCart(w, r, user)
+
+	// Ask the user to confirm the address is theirs
+	if err := sendVerificationEmail(user); err != nil {
+		log.Printf("Failed to send verification email to %s: %v", user.Email, err)
+	}
 
 	// Return response
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"token":   token,
+		"success":       true,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn(),
 		"user": map[string]string{
 			"id":    user.ID,
 			"email": user.Email,
 			"name":  user.Name,
+			"role":  user.Role,
 		},
 	})
 }
@@ -229,7 +259,9 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
 		tmpl := template.Must(template.ParseFiles("templates/login.html"))
-		tmpl.Execute(w, nil)
+		tmpl.Execute(w, map[string]interface{}{
+			"Next": localRedirectPath(r.URL.Query().Get("next")),
+		})
 		return
 	}
 
@@ -260,54 +292,56 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate JWT token
-	token, err := GenerateJWT(&user)
+	// With two-factor authentication on, the password alone doesn't sign in
+	if user.TOTPEnabled {
+		startTwoFactorLogin(w, &user)
+		return
+	}
+
+	completeLogin(w, r, &user)
+}
+
+// completeLogin signs in a user whose credentials have been checked
+func completeLogin(w http.ResponseWriter, r *http.Request, user *User) {
+	// Start a session
+	tokens, err := startSession(user)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to generate token"})
 		return
 	}
 
-	// Set cookie for browser
-	http.SetCookie(w, &http.Cookie{
-		Name:     "auth_token",
-		Value:    token,
-		Expires:  time.Now().Add(7 * 24 * time.Hour),
-		HttpOnly: true,
-		Secure:   false, // Set to true in production with HTTPS
-		SameSite: http.SameSiteLaxMode,
-		Path:     "/",
-	})
+	// Set cookies for browser
+	setAuthCookies(w, tokens)
+
+	// Move anything added to the cart while logged out into the user's cart
+	mergeGuestCart(w, r, user)
 
 	// Return response
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"token":   token,
+		"success":       true,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn(),
 		"user": map[string]string{
 			"id":    user.ID,
 			"email": user.Email,
 			"name":  user.Name,
+			"role":  user.Role,
 		},
 	})
 }
 
 // logoutHandler handles user logout
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	// Get token to blacklist it
-	cookie, err := r.Cookie("auth_token")
-	if err == nil {
-		// Delete session from database
-		DB.Where("token = ?", cookie.Value).Delete(&Session{})
-	}
-
-	// Clear cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:    "auth_token",
-		Value:   "",
-		Expires: time.Now().Add(-1 * time.Hour),
-		Path:    "/",
-	})
+	// End the session, and every session refreshed from it
+	if err := endSession(r); err != nil {
+		log.Printf("Failed to end session: %v", err)
+	}
+
+	// Clear cookies
+	clearAuthCookies(w)
 
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
@@ -320,8 +354,13 @@ func profileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	data := struct {
+		*User
+		RecoveryCodesLeft int64
+	}{user, recoveryCodesLeft(user.ID)}
+
 	tmpl := template.Must(template.ParseFiles("templates/profile.html"))
-	tmpl.Execute(w, user)
+	tmpl.Execute(w, data)
 }
 
 // updatePasswordHandler allows users to change their password
@@ -364,16 +403,35 @@ func updatePasswordHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Update password
-	if err := DB.Model(user).Update("password_hash", newHashedPassword).Error; err != nil {
+	// Update password and sign out every session, in case the old password
+	// was used to sign in somewhere else
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("password_hash", newHashedPassword).Error; err != nil {
+			return err
+		}
+		return revokeSessions(tx, user.ID)
+	})
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update password"})
 		return
 	}
 
+	// Keep this browser signed in with a fresh session
+	tokens, err := startSession(user)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to generate token"})
+		return
+	}
+	setAuthCookies(w, tokens)
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": "Password updated successfully",
+		"success":       true,
+		"message":       "Password updated successfully",
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn(),
 	})
 }
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestLocalRedirectPath(t *testing.T) {
+	tests := []struct {
+		next string
+		want string
+	}{
+		{"", "/"},
+		{"/orders", "/orders"},
+		{"/orders?page=2#latest", "/orders?page=2#latest"},
+		{"//evil.com", "/"},
+		{"/\\evil.com", "/"},
+		{"\\\\evil.com", "/"},
+		{"https://evil.com/orders", "/"},
+		{"evil.com", "/"},
+		{"/\tevil.com", "/"},
+		{"javascript:alert(1)", "/"},
+	}
+
+	for _, tt := range tests {
+		if got := localRedirectPath(tt.next); got != tt.want {
+			t.Errorf("localRedirectPath(%q) = %q, want %q", tt.next, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// defaultCancellationWindow applies when ORDER_CANCELLATION_WINDOW is unset
+const defaultCancellationWindow = 24 * time.Hour
+
+// ErrNotCancellable is returned when an order can no longer be cancelled
+var ErrNotCancellable = errors.New("order can no longer be cancelled")
+
+// cancellationWindow returns how long after placing an order customers may
+// cancel it, from ORDER_CANCELLATION_WINDOW (a Go duration such as "2h";
+// "0" turns self-service cancellation off)
+func cancellationWindow() time.Duration {
+	value := os.Getenv("ORDER_CANCELLATION_WINDOW")
+	if value == "" {
+		return defaultCancellationWindow
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil || window < 0 {
+		log.Printf("Invalid ORDER_CANCELLATION_WINDOW %q, using %s", value, defaultCancellationWindow)
+		return defaultCancellationWindow
+	}
+	return window
+}
+
+// CancelDeadline returns when the customer's chance to cancel runs out
+func (o Order) CancelDeadline() time.Time {
+	return o.CreatedAt.Add(cancellationWindow())
+}
+
+// CustomerCanCancel reports whether the customer may still cancel the order:
+// it is paid but has not started shipping, nothing has been refunded yet and
+// the cancellation window is still open. A pending order is still being
+// placed, and placeOrder releases it itself if that fails.
+func (o Order) CustomerCanCancel() bool {
+	switch o.Status {
+	case OrderStatusPaid, OrderStatusProcessing:
+	default:
+		return false
+	}
+	return o.RefundedAmount == 0 && time.Now().Before(o.CancelDeadline())
+}
+
+// cancelOrder cancels one of the user's orders: unreturned units go back in
+// stock, a captured payment is refunded in full and an uncaptured one is
+// voided. The payment provider is called outside the transaction that
+// locks the order. A captured order is only cancelled once the refund goes
+// through, so a failed refund leaves it as it was; an uncaptured one is
+// cancelled first, since an authorization that fails to void lapses anyway.
+func cancelOrder(orderID string, user *User) (*Order, *Refund, error) {
+	const reason = "Cancelled by customer"
+
+	var order *Order
+	var refund *Refund
+	var captured bool
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		order, err = lockOrder(tx, "id = ? AND user_id = ?", orderID, user.ID)
+		if err != nil {
+			return err
+		}
+		if !order.CustomerCanCancel() {
+			return ErrNotCancellable
+		}
+
+		captured = order.PaymentStatus == PaymentStatusCompleted
+		if captured {
+			// A full refund restocks every line as part of the refund
+			refund, err = recordRefund(tx, order, RefundRequest{Reason: reason, Restock: true}, user)
+			return err
+		}
+
+		if err := restockOrder(tx, order); err != nil {
+			return err
+		}
+		return transitionOrder(tx, order, OrderStatusCancelled, user, reason)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if captured {
+		err := submitRefund(order, refund, func(tx *gorm.DB, order *Order) error {
+			return transitionOrder(tx, order, OrderStatusCancelled, user, reason)
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if payment, err := Payments.Void(order.PaymentID); err != nil {
+		log.Printf("CRITICAL: order %s cancelled but payment %s not voided: %v", order.ID, order.PaymentID, err)
+	} else {
+		order.PaymentStatus = payment.Status
+		if err := DB.Model(order).Update("payment_status", payment.Status).Error; err != nil {
+			log.Printf("Failed to save voided payment of order %s: %v", order.ID, err)
+		}
+	}
+
+	log.Printf("User %s cancelled order %s", user.Email, order.ID)
+	sendCancellationEmail(user, order, refund)
+	return order, refund, nil
+}
+
+// restockOrder puts every unit of the order back in stock
+func restockOrder(tx *gorm.DB, order *Order) error {
+	for _, item := range order.Items {
+		quantity := item.RefundableQuantity()
+		if quantity <= 0 {
+			continue
+		}
+		if err := restock(tx, item.ProductID, item.VariantID, quantity); err != nil {
+			return fmt.Errorf("restock product: %w", err)
+		}
+	}
+	return nil
+}
+
+// sendCancellationEmail confirms a cancellation to the customer
+func sendCancellationEmail(user *User, order *Order, refund *Refund) {
+	var body strings.Builder
+	fmt.Fprintf(&body, "Hi %s,\n\n", user.Name)
+	fmt.Fprintf(&body, "Your order %s has been cancelled.\n\n", order.ID)
+	if refund != nil {
+		fmt.Fprintf(&body, "A refund of $%.2f has been issued to your original payment method. ", float64(refund.Amount)/100)
+		body.WriteString("Depending on your bank it can take a few business days to appear.\n\n")
+	} else {
+		body.WriteString("Your card was not charged; the pending authorization has been released.\n\n")
+	}
+	body.WriteString("Thanks for shopping with TechStore.\n")
+
+	sendEmail(EmailMessage{
+		To:      user.Email,
+		Subject: "Your TechStore order has been cancelled",
+		Body:    body.String(),
+	})
+}
+
+// cancelErrorResponse maps a cancelOrder error to a status code and message
+func cancelErrorResponse(err error) (int, string) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound, "Order not found"
+	case errors.Is(err, ErrNotCancellable):
+		return http.StatusConflict, "This order can no longer be cancelled"
+	default:
+		log.Printf("Order cancellation failed: %v", err)
+		return http.StatusBadGateway, "We couldn't cancel your order right now. Please try again or contact support."
+	}
+}
+
+// cancelOrderHandler cancels an order from the order detail page
+func cancelOrderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := getCurrentUser(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	orderID := r.FormValue("id")
+	detailURL := "/orders/detail?id=" + url.QueryEscape(orderID)
+
+	if _, _, err := cancelOrder(orderID, user); err != nil {
+		status, message := cancelErrorResponse(err)
+		if status == http.StatusNotFound {
+			http.Error(w, message, status)
+			return
+		}
+		http.Redirect(w, r, detailURL+"&error="+url.QueryEscape(message), http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(w, r, detailURL+"&notice="+url.QueryEscape("Your order has been cancelled"), http.StatusSeeOther)
+}
+
+// cancelOrderAPIHandler cancels one of the current user's orders as JSON:
+//
+//	POST /api/orders/cancel?id=X
+func cancelOrderAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	user, err := getCurrentUser(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+		return
+	}
+
+	order, refund, err := cancelOrder(r.URL.Query().Get("id"), user)
+	if err != nil {
+		status, message := cancelErrorResponse(err)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": message})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"order":   order,
+		"refund":  refund,
+	})
+}
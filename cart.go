@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Guest carts are identified by a random ID in a signed cookie; the cart
+// rows themselves live in cart_items with guest_id set instead of user_id.
+const (
+	guestCartCookie = "guest_cart"
+	guestCartTTL    = 30 * 24 * time.Hour
+)
+
+// cartOwner identifies whose cart a request operates on: a logged-in user or
+// an anonymous guest
+type cartOwner struct {
+	UserID  string
+	GuestID string
+}
+
+// scope restricts a query to the owner's cart rows
+func (o cartOwner) scope(db *gorm.DB) *gorm.DB {
+	if o.UserID != "" {
+		return db.Where("user_id = ?", o.UserID)
+	}
+	return db.Where("guest_id = ?", o.GuestID)
+}
+
+// reservationID is the ID used when checking stock held by other shoppers.
+// Guests never hold reservations, so any non-user value works.
+func (o cartOwner) reservationID() string {
+	if o.UserID != "" {
+		return o.UserID
+	}
+	return "guest:" + o.GuestID
+}
+
+// currentCart resolves the cart owner for a request. For anonymous visitors
+// it reads the guest cookie; when create is true and there is none, a new
+// guest cart is started. ok is false when there is no cart to operate on.
+func currentCart(w http.ResponseWriter, r *http.Request, create bool) (owner cartOwner, user *User, ok bool) {
+	if user, err := getCurrentUser(r); err == nil {
+		return cartOwner{UserID: user.ID}, user, true
+	}
+
+	if guestID, valid := readGuestCookie(r); valid {
+		return cartOwner{GuestID: guestID}, nil, true
+	}
+
+	if !create {
+		return cartOwner{}, nil, false
+	}
+
+	guestID := uuid.New().String()
+	setGuestCookie(w, guestID)
+	return cartOwner{GuestID: guestID}, nil, true
+}
+
+// loadCart fetches the owner's cart items with product info
+func loadCart(owner cartOwner) []CartItem {
+	var cartItems []CartItem
+	owner.scope(DB.Preload("Product").Preload("Variant")).Order("id").Find(&cartItems)
+	return cartItems
+}
+
+// cartLine narrows a cart query to the line for a product and variant
+func cartLine(db *gorm.DB, productID string, variantID *string) *gorm.DB {
+	return db.Where("product_id = ? AND variant_id IS NOT DISTINCT FROM ?", productID, variantID)
+}
+
+// countCart returns the number of lines in the owner's cart
+func countCart(owner cartOwner) int64 {
+	var count int64
+	owner.scope(DB.Model(&CartItem{})).Count(&count)
+	return count
+}
+
+// signGuestID returns the HMAC signature for a guest cart ID
+func signGuestID(guestID string) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("JWT_SECRET")))
+	mac.Write([]byte("guest-cart:" + guestID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// readGuestCookie returns the guest cart ID if the cookie's signature is valid
+func readGuestCookie(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(guestCartCookie)
+	if err != nil {
+		return "", false
+	}
+
+	guestID, signature, found := strings.Cut(cookie.Value, ".")
+	if !found || guestID == "" {
+		return "", false
+	}
+	if !hmac.Equal([]byte(signature), []byte(signGuestID(guestID))) {
+		return "", false
+	}
+	return guestID, true
+}
+
+func setGuestCookie(w http.ResponseWriter, guestID string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     guestCartCookie,
+		Value:    guestID + "." + signGuestID(guestID),
+		Expires:  time.Now().Add(guestCartTTL),
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+	})
+}
+
+func clearGuestCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:    guestCartCookie,
+		Value:   "",
+		Expires: time.Now().Add(-1 * time.Hour),
+		Path:    "/",
+	})
+}
+
+// mergeGuestCart moves the visitor's guest cart into the user's cart after
+// login or registration. Quantities for the same product and variant are
+// summed and capped at the stock available to the user. The guest cookie
+// is only cleared once the merge commits, so a failed merge can be retried
+// at the next login.
+func mergeGuestCart(w http.ResponseWriter, r *http.Request, user *User) {
+	guestID, ok := readGuestCookie(r)
+	if !ok {
+		return
+	}
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var guestItems []CartItem
+		if err := tx.Preload("Product").Where("guest_id = ?", guestID).Find(&guestItems).Error; err != nil {
+			return err
+		}
+
+		for _, guestItem := range guestItems {
+			if guestItem.Product.ArchivedAt != nil {
+				continue
+			}
+
+			var userItem CartItem
+			found := cartLine(tx.Where("user_id = ?", user.ID), guestItem.ProductID, guestItem.VariantID).First(&userItem).Error == nil
+
+			available, err := availableStock(tx, guestItem.ProductID, guestItem.VariantID, user.ID)
+			if err != nil {
+				return err
+			}
+			quantity := userItem.Quantity + guestItem.Quantity
+			if quantity > available {
+				quantity = available
+			}
+
+			switch {
+			case found && quantity > userItem.Quantity:
+				if err := tx.Model(&userItem).Update("quantity", quantity).Error; err != nil {
+					return err
+				}
+			case !found && quantity > 0:
+				newItem := CartItem{
+					UserID:    user.ID,
+					ProductID: guestItem.ProductID,
+					VariantID: guestItem.VariantID,
+					Quantity:  quantity,
+				}
+				if err := tx.Create(&newItem).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		return tx.Where("guest_id = ?", guestID).Delete(&CartItem{}).Error
+	})
+	if err != nil {
+		log.Printf("Failed to merge guest cart %s into user %s: %v", guestID, user.ID, err)
+		return
+	}
+	clearGuestCookie(w)
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// catalogSort describes one storefront ordering. Column doubles as the
+// keyset column for cursor pagination, with products.id as the tie-breaker.
+type catalogSort struct {
+	Column string
+	Desc   bool
+}
+
+// orderBy returns the ORDER BY clause for the sort
+func (s catalogSort) orderBy() string {
+	dir := "ASC"
+	if s.Desc {
+		dir = "DESC"
+	}
+	return s.Column + " " + dir + ", products.id " + dir
+}
+
+// Catalog sort options accepted in the "sort" query parameter
+// ("relevance" has no column since it ranks against the search text).
+var catalogSorts = map[string]catalogSort{
+	"relevance":  {},
+	"name":       {Column: "products.name"},
+	"price_asc":  {Column: "products.price"},
+	"price_desc": {Column: "products.price", Desc: true},
+	"newest":     {Column: "products.created_at", Desc: true},
+}
+
+const defaultCatalogSort = "name"
+
+// Catalog page sizes for the storefront and /api/products
+const (
+	catalogPageSize    = 12
+	maxCatalogPageSize = 100
+)
+
+// ErrInvalidCursor is returned for page cursors that are malformed or were
+// issued for a different sort order
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// catalogFilter holds the storefront's browse parameters
+type catalogFilter struct {
+	Query    string // full-text search
+	Category string // category slug; includes its descendants
+	Tag      string // tag slug
+	MinPrice int64  // in cents, 0 for no lower bound
+	MaxPrice int64  // in cents, 0 for no upper bound
+	Sort     string
+}
+
+// parseCatalogFilter reads browse parameters from the query string.
+// Prices are given in dollars; invalid values are ignored.
+func parseCatalogFilter(r *http.Request) catalogFilter {
+	q := r.URL.Query()
+	f := catalogFilter{
+		Query:    strings.TrimSpace(q.Get("q")),
+		Category: q.Get("category"),
+		Tag:      q.Get("tag"),
+		Sort:     q.Get("sort"),
+	}
+	if cents, err := parsePriceCents(q.Get("min_price")); err == nil {
+		f.MinPrice = cents
+	}
+	if cents, err := parsePriceCents(q.Get("max_price")); err == nil {
+		f.MaxPrice = cents
+	}
+	if _, ok := catalogSorts[f.Sort]; !ok {
+		f.Sort = ""
+	}
+
+	// Searches rank by relevance unless the shopper picked another order
+	hasSearch := prefixTSQuery(f.Query) != ""
+	if f.Sort == "" && hasSearch {
+		f.Sort = "relevance"
+	}
+	if f.Sort == "" || (f.Sort == "relevance" && !hasSearch) {
+		f.Sort = defaultCatalogSort
+	}
+	return f
+}
+
+// apply adds the filter's conditions and ordering to a product query
+func (f catalogFilter) apply(db *gorm.DB) *gorm.DB {
+	db = db.Where("products.archived_at IS NULL")
+	db = applySearch(db, f.Query)
+
+	if f.Category != "" {
+		db = db.Where(`products.category_id IN (
+			WITH RECURSIVE tree AS (
+				SELECT id FROM categories WHERE slug = ?
+				UNION ALL
+				SELECT c.id FROM categories c JOIN tree t ON c.parent_id = t.id
+			)
+			SELECT id FROM tree)`, f.Category)
+	}
+	if f.Tag != "" {
+		db = db.Where(`products.id IN (
+			SELECT pt.product_id FROM product_tags pt
+			JOIN tags ON tags.id = pt.tag_id
+			WHERE tags.slug = ?)`, f.Tag)
+	}
+	if f.MinPrice > 0 {
+		db = db.Where("products.price >= ?", f.MinPrice)
+	}
+	if f.MaxPrice > 0 {
+		db = db.Where("products.price <= ?", f.MaxPrice)
+	}
+
+	if f.Sort == "relevance" {
+		return orderBySearchRank(db, f.Query)
+	}
+	return db.Order(catalogSorts[f.Sort].orderBy())
+}
+
+// MinPriceDollars and MaxPriceDollars echo the price bounds back into the form
+func (f catalogFilter) MinPriceDollars() float64 { return float64(f.MinPrice) / 100 }
+func (f catalogFilter) MaxPriceDollars() float64 { return float64(f.MaxPrice) / 100 }
+
+// IsActive reports whether any filter beyond the default sort is set
+func (f catalogFilter) IsActive() bool {
+	return f.Query != "" || f.Category != "" || f.Tag != "" || f.MinPrice > 0 || f.MaxPrice > 0
+}
+
+// values encodes the filter back into query parameters
+func (f catalogFilter) values() url.Values {
+	v := url.Values{}
+	if f.Query != "" {
+		v.Set("q", f.Query)
+	}
+	if f.Category != "" {
+		v.Set("category", f.Category)
+	}
+	if f.Tag != "" {
+		v.Set("tag", f.Tag)
+	}
+	if f.MinPrice > 0 {
+		v.Set("min_price", fmt.Sprintf("%.2f", f.MinPriceDollars()))
+	}
+	if f.MaxPrice > 0 {
+		v.Set("max_price", fmt.Sprintf("%.2f", f.MaxPriceDollars()))
+	}
+	v.Set("sort", f.Sort)
+	return v
+}
+
+// pageURL returns the storefront URL for the filtered page at cursor
+func (f catalogFilter) pageURL(cursor string) string {
+	v := f.values()
+	v.Set("cursor", cursor)
+	return "/?" + v.Encode()
+}
+
+// catalogCursor marks where the next catalog page starts. Sorts with a
+// column use keyset pagination from the last row seen, which stays fast at
+// any depth; relevance ranking falls back to an offset.
+type catalogCursor struct {
+	Sort   string `json:"s"`
+	Value  string `json:"v,omitempty"`
+	ID     string `json:"id,omitempty"`
+	Offset int    `json:"o,omitempty"`
+}
+
+// cursorAfter returns the cursor continuing after product p, which sits at
+// position offset-1 in the listing
+func cursorAfter(sort string, p Product, offset int) catalogCursor {
+	c := catalogCursor{Sort: sort, ID: p.ID}
+	switch sort {
+	case "name":
+		c.Value = p.Name
+	case "price_asc", "price_desc":
+		c.Value = strconv.FormatInt(p.Price, 10)
+	case "newest":
+		c.Value = p.CreatedAt.Format(time.RFC3339Nano)
+	default:
+		return catalogCursor{Sort: sort, Offset: offset}
+	}
+	return c
+}
+
+// encode returns the opaque token handed to clients
+func (c catalogCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCatalogCursor parses a token from encode, checking it matches sort
+func decodeCatalogCursor(token, sort string) (catalogCursor, error) {
+	var c catalogCursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || json.Unmarshal(data, &c) != nil {
+		return c, ErrInvalidCursor
+	}
+	if c.Sort != sort || c.Offset < 0 {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// keyValue converts the cursor's sort value back to the column's type
+func (c catalogCursor) keyValue() (interface{}, error) {
+	switch c.Sort {
+	case "price_asc", "price_desc":
+		return strconv.ParseInt(c.Value, 10, 64)
+	case "newest":
+		return time.Parse(time.RFC3339Nano, c.Value)
+	default:
+		return c.Value, nil
+	}
+}
+
+// catalogPageRequest holds the pagination parameters of a catalog request:
+// a limit plus either an offset or a cursor from a previous page
+type catalogPageRequest struct {
+	Limit  int
+	Offset int
+	Cursor string
+}
+
+// parseCatalogPage reads limit, offset and cursor with sane bounds
+func parseCatalogPage(r *http.Request) catalogPageRequest {
+	q := r.URL.Query()
+	req := catalogPageRequest{Cursor: q.Get("cursor")}
+
+	req.Limit, _ = strconv.Atoi(q.Get("limit"))
+	if req.Limit < 1 {
+		req.Limit = catalogPageSize
+	}
+	if req.Limit > maxCatalogPageSize {
+		req.Limit = maxCatalogPageSize
+	}
+	req.Offset, _ = strconv.Atoi(q.Get("offset"))
+	if req.Offset < 0 {
+		req.Offset = 0
+	}
+	return req
+}
+
+// catalogPage is one page of filtered products
+type catalogPage struct {
+	Products   []Product
+	NextCursor string // empty on the last page
+}
+
+// loadCatalogPage fetches one page of products matching the filter
+func loadCatalogPage(db *gorm.DB, f catalogFilter, req catalogPageRequest) (catalogPage, error) {
+	query := f.apply(db)
+	offset := req.Offset
+
+	if req.Cursor != "" {
+		cursor, err := decodeCatalogCursor(req.Cursor, f.Sort)
+		if err != nil {
+			return catalogPage{}, err
+		}
+
+		sort := catalogSorts[f.Sort]
+		if sort.Column == "" {
+			offset = cursor.Offset
+		} else {
+			value, err := cursor.keyValue()
+			if err != nil {
+				return catalogPage{}, ErrInvalidCursor
+			}
+			op := ">"
+			if sort.Desc {
+				op = "<"
+			}
+			query = query.Where("("+sort.Column+", products.id) "+op+" (?, ?)", value, cursor.ID)
+			offset = 0
+		}
+	}
+
+	// Fetch one extra row to learn whether another page follows
+	products := []Product{}
+	if err := query.Offset(offset).Limit(req.Limit + 1).Find(&products).Error; err != nil {
+		return catalogPage{}, err
+	}
+
+	page := catalogPage{Products: products}
+	if len(products) > req.Limit {
+		page.Products = products[:req.Limit]
+		last := page.Products[req.Limit-1]
+		page.NextCursor = cursorAfter(f.Sort, last, offset+req.Limit).encode()
+	}
+	return page, nil
+}
+
+// productsAPIHandler lists the catalog as JSON. It takes the storefront's
+// filter parameters plus limit and either offset or cursor:
+//
+//	GET /api/products?category=audio&sort=price_asc&limit=20
+//	GET /api/products?category=audio&sort=price_asc&limit=20&cursor=<next_cursor>
+func productsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	filter := parseCatalogFilter(r)
+	pageReq := parseCatalogPage(r)
+	page, err := loadCatalogPage(DB.Preload("Category").Preload("Tags").Preload("Variants", liveVariants), filter, pageReq)
+	if errors.Is(err, ErrInvalidCursor) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid cursor"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load products: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load products"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"products":    page.Products,
+		"limit":       pageReq.Limit,
+		"next_cursor": page.NextCursor,
+		"has_more":    page.NextCursor != "",
+	})
+}
+
+// loadCategoryTree returns root categories with their children loaded
+func loadCategoryTree() []Category {
+	var roots []Category
+	DB.Preload("Children", func(db *gorm.DB) *gorm.DB {
+		return db.Order("name")
+	}).Where("parent_id IS NULL").Order("name").Find(&roots)
+	return roots
+}
+
+// loadTags returns every tag in use by an active product
+func loadTags() []Tag {
+	var tags []Tag
+	DB.Where(`id IN (
+		SELECT pt.tag_id FROM product_tags pt
+		JOIN products p ON p.id = pt.product_id
+		WHERE p.archived_at IS NULL)`).Order("name").Find(&tags)
+	return tags
+}
+
+var nonSlugChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// slugify turns a display name into a URL-safe identifier
+func slugify(name string) string {
+	return strings.Trim(nonSlugChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// findOrCreateTags resolves tag names to Tag rows, creating missing ones
+func findOrCreateTags(db *gorm.DB, names []string) ([]Tag, error) {
+	tags := []Tag{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		slug := slugify(name)
+		if slug == "" || seen[slug] {
+			continue
+		}
+		seen[slug] = true
+
+		tag := Tag{Name: name, Slug: slug}
+		if err := db.Where(Tag{Slug: slug}).FirstOrCreate(&tag).Error; err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// adminCategoriesAPIHandler lists and creates categories:
+//
+//	GET  /api/admin/categories   category tree
+//	POST /api/admin/categories   {"name": "Cables", "parent_id": "..."}
+func adminCategoriesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(map[string]interface{}{"categories": loadCategoryTree()})
+
+	case http.MethodPost:
+		var req struct {
+			Name     string  `json:"name"`
+			ParentID *string `json:"parent_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+			return
+		}
+
+		category := Category{Name: strings.TrimSpace(req.Name), Slug: slugify(req.Name)}
+		if category.Slug == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Name is required"})
+			return
+		}
+		if req.ParentID != nil && *req.ParentID != "" {
+			var parent Category
+			if err := DB.Where("id = ?", *req.ParentID).First(&parent).Error; err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Parent category not found"})
+				return
+			}
+			category.ParentID = &parent.ID
+		}
+
+		if err := DB.Create(&category).Error; err != nil {
+			log.Printf("Failed to create category: %v", err)
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "A category with that name already exists"})
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "category": category})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+	}
+}
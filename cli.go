@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// runCommand executes a management sub-command and returns the exit code.
+//
+//	create-admin -email you@example.com -name "Your Name" -password secret
+//	set-role -email someone@example.com -role support
+//	reset-2fa -email someone@example.com
+func runCommand(args []string) int {
+	switch args[0] {
+	case "create-admin":
+		return createAdminCommand(args[1:])
+	case "set-role":
+		return setRoleCommand(args[1:])
+	case "reset-2fa":
+		return resetTwoFactorCommand(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q (available: create-admin, set-role, reset-2fa)\n", args[0])
+		return 2
+	}
+}
+
+// createAdminCommand bootstraps an admin account, or promotes an existing
+// account with the same email
+func createAdminCommand(args []string) int {
+	fs := flag.NewFlagSet("create-admin", flag.ContinueOnError)
+	email := fs.String("email", "", "admin email address")
+	name := fs.String("name", "Administrator", "display name")
+	password := fs.String("password", os.Getenv("ADMIN_PASSWORD"), "password (defaults to $ADMIN_PASSWORD)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	*email = strings.TrimSpace(*email)
+	if *email == "" {
+		fmt.Fprintln(os.Stderr, "-email is required")
+		return 2
+	}
+
+	var existing User
+	if err := DB.Where("email = ?", *email).First(&existing).Error; err == nil {
+		if err := DB.Model(&existing).Update("role", RoleAdmin).Error; err != nil {
+			fmt.Fprintf(os.Stderr, "failed to promote %s: %v\n", *email, err)
+			return 1
+		}
+		fmt.Printf("Promoted existing user %s to admin\n", *email)
+		return 0
+	}
+
+	if len(*password) < 8 {
+		fmt.Fprintln(os.Stderr, "-password must be at least 8 characters")
+		return 2
+	}
+
+	// Mirror the browser's PBKDF2 step so the account can log in normally
+	clientHash, err := clientPasswordHash(*email, *password)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to hash password: %v\n", err)
+		return 1
+	}
+	hashedPassword, err := HashPassword(clientHash)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to hash password: %v\n", err)
+		return 1
+	}
+
+	user := &User{
+		ID:           uuid.New().String(),
+		Email:        *email,
+		PasswordHash: hashedPassword,
+		Name:         *name,
+		Role:         RoleAdmin,
+		CreatedAt:    time.Now(),
+
+		EmailVerified: true, // created by the operator
+	}
+	if err := DB.Create(user).Error; err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create admin: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Created admin %s\n", *email)
+	return 0
+}
+
+// setRoleCommand changes the role of an existing user
+func setRoleCommand(args []string) int {
+	fs := flag.NewFlagSet("set-role", flag.ContinueOnError)
+	email := fs.String("email", "", "user email address")
+	role := fs.String("role", "", "customer, support or admin")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if !validRole(*role) {
+		fmt.Fprintf(os.Stderr, "unknown role %q\n", *role)
+		return 2
+	}
+
+	result := DB.Model(&User{}).Where("email = ?", strings.TrimSpace(*email)).Update("role", *role)
+	if result.Error != nil {
+		fmt.Fprintf(os.Stderr, "failed to update role: %v\n", result.Error)
+		return 1
+	}
+	if result.RowsAffected == 0 {
+		fmt.Fprintf(os.Stderr, "no user with email %q\n", *email)
+		return 1
+	}
+
+	fmt.Printf("Set role of %s to %s\n", *email, *role)
+	return 0
+}
+
+// resetTwoFactorCommand turns off two-factor authentication for a user who
+// has lost both their authenticator and their recovery codes. Staff will be
+// asked to set it up again before using their privileges.
+func resetTwoFactorCommand(args []string) int {
+	fs := flag.NewFlagSet("reset-2fa", flag.ContinueOnError)
+	email := fs.String("email", "", "user email address")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var user User
+	if err := DB.Where("email = ?", strings.TrimSpace(*email)).First(&user).Error; err != nil {
+		fmt.Fprintf(os.Stderr, "no user with email %q\n", *email)
+		return 1
+	}
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := turnOffTwoFactor(tx, &user); err != nil {
+			return err
+		}
+		return revokeSessions(tx, user.ID)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to reset two-factor authentication: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Turned off two-factor authentication for %s and signed them out everywhere\n", user.Email)
+	return 0
+}
+
+// clientPasswordHash reproduces the PBKDF2 hashing done in the browser
+// (see register.html): SHA-256 of the lowercased email as the salt, 1000
+// iterations, 32-byte key, hex encoded
+func clientPasswordHash(email, password string) (string, error) {
+	salt := sha256.Sum256([]byte(strings.ToLower(email)))
+	key, err := pbkdf2.Key(sha256.New, password, []byte(hex.EncodeToString(salt[:])), 1000, 32)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
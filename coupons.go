@@ -0,0 +1,604 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The coupon applied in the cart is remembered in a cookie until checkout.
+// It is only a code; every use is validated again on the server.
+const (
+	couponCookie = "coupon_code"
+	couponTTL    = 7 * 24 * time.Hour
+)
+
+// ErrCouponInvalid is returned when a coupon cannot be used on a cart
+var ErrCouponInvalid = errors.New("coupon cannot be used")
+
+// CouponError explains to the customer why a coupon was turned down
+type CouponError struct {
+	Reason string
+}
+
+func (e *CouponError) Error() string {
+	return e.Reason
+}
+
+// Is lets callers match any CouponError with errors.Is(err, ErrCouponInvalid)
+func (e *CouponError) Is(target error) bool {
+	return target == ErrCouponInvalid
+}
+
+func couponError(format string, args ...interface{}) error {
+	return &CouponError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// CouponDiscount is what a coupon takes off a particular cart
+type CouponDiscount struct {
+	CouponID    string  `json:"coupon_id,omitempty"`
+	Code        string  `json:"code,omitempty"`
+	Description string  `json:"description,omitempty"`
+	ItemAmounts []int64 `json:"-"`              // taken off each cart line, in cart order
+	Items       int64   `json:"items_cents"`    // sum of ItemAmounts
+	Shipping    int64   `json:"shipping_cents"` // shipping charge waived
+}
+
+// Total returns the whole discount, items and shipping
+func (d CouponDiscount) Total() int64 {
+	return d.Items + d.Shipping
+}
+
+// noDiscount is the discount for a cart without a coupon
+func noDiscount(items []CartItem) CouponDiscount {
+	return CouponDiscount{ItemAmounts: make([]int64, len(items))}
+}
+
+var couponCodePattern = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+// normalizeCouponCode makes codes case-insensitive
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// findCoupon loads an active coupon by code with its product and category scope
+func findCoupon(db *gorm.DB, code string) (*Coupon, error) {
+	var coupon Coupon
+	err := db.Preload("Products").Preload("Categories").
+		Where("code = ? AND active = ?", normalizeCouponCode(code), true).
+		First(&coupon).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, couponError("%s is not a valid coupon code", normalizeCouponCode(code))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &coupon, nil
+}
+
+// couponUses counts redemptions of a coupon on orders that were not
+// cancelled, by one user or, with an empty userID, by everyone
+func couponUses(db *gorm.DB, couponID, userID string) (int64, error) {
+	query := db.Model(&CouponRedemption{}).
+		Joins("JOIN orders ON orders.id = coupon_redemptions.order_id").
+		Where("coupon_redemptions.coupon_id = ? AND orders.status <> ?", couponID, OrderStatusCancelled)
+	if userID != "" {
+		query = query.Where("coupon_redemptions.user_id = ?", userID)
+	}
+
+	var count int64
+	err := query.Count(&count).Error
+	return count, err
+}
+
+// checkLimits verifies the coupon has uses left overall and for userID.
+// Guests have no per-customer history; they are checked at checkout.
+func (c *Coupon) checkLimits(db *gorm.DB, userID string) error {
+	if c.MaxUses > 0 {
+		uses, err := couponUses(db, c.ID, "")
+		if err != nil {
+			return err
+		}
+		if uses >= int64(c.MaxUses) {
+			return couponError("Coupon %s has reached its usage limit", c.Code)
+		}
+	}
+	if c.MaxUsesPerUser > 0 && userID != "" {
+		uses, err := couponUses(db, c.ID, userID)
+		if err != nil {
+			return err
+		}
+		if uses >= int64(c.MaxUsesPerUser) {
+			return couponError("You have already used coupon %s", c.Code)
+		}
+	}
+	return nil
+}
+
+// check verifies the coupon can be used now on a cart with this subtotal
+func (c *Coupon) check(db *gorm.DB, userID string, subtotal int64, now time.Time) error {
+	if c.StartsAt != nil && now.Before(*c.StartsAt) {
+		return couponError("Coupon %s is not active yet", c.Code)
+	}
+	if c.ExpiresAt != nil && !now.Before(*c.ExpiresAt) {
+		return couponError("Coupon %s has expired", c.Code)
+	}
+	if subtotal < c.MinSubtotal {
+		return couponError("Coupon %s needs a subtotal of at least $%.2f", c.Code, float64(c.MinSubtotal)/100)
+	}
+	return c.checkLimits(db, userID)
+}
+
+// eligibility returns a test for whether the coupon discounts a product.
+// Scoped categories include their subcategories.
+func (c *Coupon) eligibility(db *gorm.DB) (func(Product) bool, error) {
+	if len(c.Products) == 0 && len(c.Categories) == 0 {
+		return func(Product) bool { return true }, nil
+	}
+
+	products := map[string]bool{}
+	for _, p := range c.Products {
+		products[p.ID] = true
+	}
+
+	categories := map[string]bool{}
+	if len(c.Categories) > 0 {
+		roots := make([]string, len(c.Categories))
+		for i, category := range c.Categories {
+			roots[i] = category.ID
+		}
+
+		var ids []string
+		err := db.Raw(`WITH RECURSIVE tree AS (
+				SELECT id FROM categories WHERE id IN ?
+				UNION ALL
+				SELECT c.id FROM categories c JOIN tree t ON c.parent_id = t.id
+			)
+			SELECT id FROM tree`, roots).Scan(&ids).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			categories[id] = true
+		}
+	}
+
+	return func(p Product) bool {
+		return products[p.ID] || (p.CategoryID != nil && categories[*p.CategoryID])
+	}, nil
+}
+
+// discount works out what the coupon takes off the eligible cart lines.
+// A fixed amount is spread over the lines in proportion to their value, so
+// each line's tax and refunds reflect its share.
+func (c *Coupon) discount(items []CartItem, eligible func(Product) bool, shippingCost int64) CouponDiscount {
+	d := noDiscount(items)
+	d.CouponID = c.ID
+	d.Code = c.Code
+	d.Description = c.Description
+
+	var eligibleTotal int64
+	last := -1
+	for i, item := range items {
+		if eligible(item.Product) {
+			eligibleTotal += item.LineAmount()
+			last = i
+		}
+	}
+
+	switch c.Kind {
+	case CouponPercent:
+		for i, item := range items {
+			if eligible(item.Product) {
+				d.ItemAmounts[i] = item.LineAmount() * c.Value / 100
+			}
+		}
+	case CouponFixed:
+		off := c.Value
+		if off > eligibleTotal {
+			off = eligibleTotal
+		}
+		var allocated int64
+		for i, item := range items {
+			if !eligible(item.Product) || i == last {
+				continue
+			}
+			d.ItemAmounts[i] = off * item.LineAmount() / eligibleTotal
+			allocated += d.ItemAmounts[i]
+		}
+		if last >= 0 {
+			// The last line absorbs the rounding
+			d.ItemAmounts[last] = off - allocated
+		}
+	case CouponFreeShipping:
+		d.Shipping = shippingCost
+	}
+
+	for _, amount := range d.ItemAmounts {
+		d.Items += amount
+	}
+	return d
+}
+
+// applyCoupon validates code for userID's cart and works out its discount.
+// The minimum spend is checked against the whole cart subtotal, and
+// shippingCost is the charge a free-shipping coupon waives. An empty code
+// gives no discount.
+func applyCoupon(code, userID string, items []CartItem, subtotal, shippingCost int64) (CouponDiscount, error) {
+	if normalizeCouponCode(code) == "" {
+		return noDiscount(items), nil
+	}
+
+	coupon, err := findCoupon(DB, code)
+	if err != nil {
+		return noDiscount(items), err
+	}
+	if err := coupon.check(DB, userID, subtotal, time.Now()); err != nil {
+		return noDiscount(items), err
+	}
+
+	eligible, err := coupon.eligibility(DB)
+	if err != nil {
+		return noDiscount(items), err
+	}
+	hasEligible := false
+	for _, item := range items {
+		if eligible(item.Product) {
+			hasEligible = true
+			break
+		}
+	}
+	if !hasEligible {
+		return noDiscount(items), couponError("Coupon %s does not apply to anything in your cart", coupon.Code)
+	}
+
+	return coupon.discount(items, eligible, shippingCost), nil
+}
+
+// redeemCoupon records the discount against an order. The coupon row is
+// locked while its limits are checked again, so concurrent checkouts cannot
+// use it more often than allowed.
+func redeemCoupon(tx *gorm.DB, discount CouponDiscount, userID, orderID string) error {
+	var coupon Coupon
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ? AND active = ?", discount.CouponID, true).
+		First(&coupon).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return couponError("Coupon %s is no longer available", discount.Code)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := coupon.checkLimits(tx, userID); err != nil {
+		return err
+	}
+
+	return tx.Create(&CouponRedemption{
+		CouponID: coupon.ID,
+		UserID:   userID,
+		OrderID:  orderID,
+		Amount:   discount.Total(),
+	}).Error
+}
+
+// readCouponCookie returns the code applied in the cart, if any
+func readCouponCookie(r *http.Request) string {
+	cookie, err := r.Cookie(couponCookie)
+	if err != nil {
+		return ""
+	}
+	return normalizeCouponCode(cookie.Value)
+}
+
+func setCouponCookie(w http.ResponseWriter, code string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     couponCookie,
+		Value:    code,
+		Expires:  time.Now().Add(couponTTL),
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+	})
+}
+
+func clearCouponCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:    couponCookie,
+		Value:   "",
+		Expires: time.Now().Add(-1 * time.Hour),
+		Path:    "/",
+	})
+}
+
+// cartCouponHandler applies (POST, form field "code") or removes (DELETE)
+// the cart's coupon and re-renders the cart summary (HTMX)
+func cartCouponHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.New("cart.html").Funcs(template.FuncMap{
+		"divf": func(a, b int64) float64 {
+			return float64(a) / float64(b)
+		},
+	})
+
+	tmpl, err := tmpl.ParseFiles("templates/cart.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Template error: %v", err)
+		return
+	}
+
+	code := readCouponCookie(r)
+	entered := ""
+	var attemptErr error
+
+	switch r.Method {
+	case http.MethodPost:
+		entered = normalizeCouponCode(r.FormValue("code"))
+		if entered == "" {
+			attemptErr = couponError("Enter a coupon code")
+			break
+		}
+
+		owner, user, _ := currentCart(w, r, false)
+		userID := ""
+		if user != nil {
+			userID = user.ID
+		}
+		pricing := pricingOptions{UserID: userID, CouponCode: entered, Strict: true}
+		if _, err := priceCart(loadCart(owner), pricing); err != nil {
+			attemptErr = err
+			break
+		}
+		code = entered
+		setCouponCookie(w, code)
+
+	case http.MethodDelete:
+		code = ""
+		clearCouponCookie(w)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := cartPageData(w, r, code)
+	if err != nil {
+		log.Printf("Failed to price cart: %v", err)
+		http.Error(w, "Failed to load cart", http.StatusInternalServerError)
+		return
+	}
+	if attemptErr != nil {
+		var couponErr *CouponError
+		if !errors.As(attemptErr, &couponErr) {
+			log.Printf("Failed to apply coupon: %v", attemptErr)
+			attemptErr = errors.New("Could not apply the coupon, please try again")
+		}
+		data["CouponCode"] = entered
+		data["CouponError"] = attemptErr.Error()
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "cart-summary", data); err != nil {
+		log.Printf("Template execution error: %v", err)
+	}
+}
+
+// couponInput is the editable subset of a Coupon
+type couponInput struct {
+	Code           string     `json:"code"`
+	Description    string     `json:"description"`
+	Kind           string     `json:"kind"`
+	Value          int64      `json:"value"`
+	MinSubtotal    int64      `json:"min_subtotal_cents"`
+	StartsAt       *time.Time `json:"starts_at"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+	MaxUses        int        `json:"max_uses"`
+	MaxUsesPerUser int        `json:"max_uses_per_user"`
+	Active         *bool      `json:"active"` // defaults to true
+	ProductIDs     []string   `json:"product_ids"`
+	CategoryIDs    []string   `json:"category_ids"`
+}
+
+// validate checks the input and normalizes the code
+func (in *couponInput) validate() error {
+	in.Code = normalizeCouponCode(in.Code)
+	in.Description = strings.TrimSpace(in.Description)
+
+	if !couponCodePattern.MatchString(in.Code) {
+		return errors.New("Code must be 3 to 32 letters, digits, dashes or underscores")
+	}
+	switch in.Kind {
+	case CouponPercent:
+		if in.Value < 1 || in.Value > 100 {
+			return errors.New("Percentage must be between 1 and 100")
+		}
+	case CouponFixed:
+		if in.Value <= 0 {
+			return errors.New("Amount must be greater than zero")
+		}
+	case CouponFreeShipping:
+		in.Value = 0
+	default:
+		return errors.New("Kind must be percent, fixed or free_shipping")
+	}
+	if in.MinSubtotal < 0 {
+		return errors.New("Minimum subtotal cannot be negative")
+	}
+	if in.MaxUses < 0 || in.MaxUsesPerUser < 0 {
+		return errors.New("Usage limits cannot be negative")
+	}
+	if in.StartsAt != nil && in.ExpiresAt != nil && !in.ExpiresAt.After(*in.StartsAt) {
+		return errors.New("Expiry must be after the start date")
+	}
+	return nil
+}
+
+// loadScope resolves the input's product and category IDs
+func (in couponInput) loadScope() ([]Product, []Category, error) {
+	products := []Product{}
+	if len(in.ProductIDs) > 0 {
+		DB.Where("id IN ?", in.ProductIDs).Find(&products)
+		if len(products) != len(in.ProductIDs) {
+			return nil, nil, errors.New("Unknown product")
+		}
+	}
+
+	categories := []Category{}
+	if len(in.CategoryIDs) > 0 {
+		DB.Where("id IN ?", in.CategoryIDs).Find(&categories)
+		if len(categories) != len(in.CategoryIDs) {
+			return nil, nil, errors.New("Unknown category")
+		}
+	}
+	return products, categories, nil
+}
+
+// apply copies the input onto a coupon
+func (in couponInput) apply(c *Coupon) {
+	c.Code = in.Code
+	c.Description = in.Description
+	c.Kind = in.Kind
+	c.Value = in.Value
+	c.MinSubtotal = in.MinSubtotal
+	c.StartsAt = in.StartsAt
+	c.ExpiresAt = in.ExpiresAt
+	c.MaxUses = in.MaxUses
+	c.MaxUsesPerUser = in.MaxUsesPerUser
+	c.Active = in.Active == nil || *in.Active
+}
+
+// saveCoupon creates or updates a coupon and replaces its scope
+func saveCoupon(coupon *Coupon, products []Product, categories []Category, create bool) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if create {
+			coupon.ID = uuid.New().String()
+			err = tx.Omit("Products", "Categories").Create(coupon).Error
+		} else {
+			err = tx.Omit("Products", "Categories").Save(coupon).Error
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Model(coupon).Association("Products").Replace(products); err != nil {
+			return err
+		}
+		if err := tx.Model(coupon).Association("Categories").Replace(categories); err != nil {
+			return err
+		}
+		coupon.Products = products
+		coupon.Categories = categories
+		return nil
+	})
+}
+
+// adminCouponsAPIHandler manages coupons as JSON:
+//
+//	GET    /api/admin/coupons         list every coupon
+//	GET    /api/admin/coupons?id=X    one coupon with its redemption count
+//	POST   /api/admin/coupons         add a coupon
+//	PUT    /api/admin/coupons?id=X    replace a coupon
+//	DELETE /api/admin/coupons?id=X    deactivate a coupon
+func adminCouponsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	couponID := r.URL.Query().Get("id")
+
+	var coupon Coupon
+	if couponID != "" {
+		if err := DB.Preload("Products").Preload("Categories").Where("id = ?", couponID).First(&coupon).Error; err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Coupon not found"})
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if couponID != "" {
+			uses, _ := couponUses(DB, coupon.ID, "")
+			json.NewEncoder(w).Encode(map[string]interface{}{"coupon": coupon, "uses": uses})
+			return
+		}
+
+		var coupons []Coupon
+		DB.Preload("Products").Preload("Categories").Order("created_at DESC").Find(&coupons)
+		json.NewEncoder(w).Encode(map[string]interface{}{"coupons": coupons})
+
+	case http.MethodPost, http.MethodPut:
+		if r.Method == http.MethodPut && couponID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Coupon id is required"})
+			return
+		}
+
+		var in couponInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+			return
+		}
+		if err := in.validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		products, categories, err := in.loadScope()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+
+		var taken int64
+		DB.Model(&Coupon{}).Where("code = ? AND id <> ?", in.Code, coupon.ID).Count(&taken)
+		if taken > 0 {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "A coupon with that code already exists"})
+			return
+		}
+
+		in.apply(&coupon)
+		create := r.Method == http.MethodPost
+		if err := saveCoupon(&coupon, products, categories, create); err != nil {
+			log.Printf("Failed to save coupon: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save coupon"})
+			return
+		}
+
+		if create {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "coupon": coupon})
+
+	case http.MethodDelete:
+		if couponID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Coupon id is required"})
+			return
+		}
+		// Redemptions point at the coupon, so it is deactivated rather than deleted
+		if err := DB.Model(&coupon).Update("active", false).Error; err != nil {
+			log.Printf("Failed to deactivate coupon: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to deactivate coupon"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "coupon": coupon})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+	}
+}
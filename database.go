@@ -1,8 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"time"
 
 	"gorm.io/driver/postgres"
@@ -40,18 +42,130 @@ func InitDatabase() {
 	if err := seedData(); err != nil {
 		log.Printf("Warning: Failed to seed data: %v", err)
 	}
+	if err := seedCatalog(); err != nil {
+		log.Printf("Warning: Failed to seed categories: %v", err)
+	}
+	if err := seedShippingMethods(); err != nil {
+		log.Printf("Warning: Failed to seed shipping methods: %v", err)
+	}
+	if err := seedTaxRates(); err != nil {
+		log.Printf("Warning: Failed to seed tax rates: %v", err)
+	}
 }
 
 // runMigrations creates all necessary tables
 func runMigrations() error {
-	return DB.AutoMigrate(
+	// Sessions used to hold a long-lived token rather than a refresh token
+	// hash; those logins cannot be refreshed, so they are dropped
+	if DB.Migrator().HasColumn(&Session{}, "token") {
+		if err := DB.Exec("DELETE FROM sessions").Error; err != nil {
+			return err
+		}
+		if err := DB.Migrator().DropColumn(&Session{}, "token"); err != nil {
+			return err
+		}
+	}
+
+	// Accounts created before email verification existed are trusted as
+	// they are rather than locked out of checkout
+	grandfatherVerified := DB.Migrator().HasTable(&User{}) && !DB.Migrator().HasColumn(&User{}, "email_verified")
+
+	// Orders from before fulfillment was tracked separately learn it from
+	// their status history
+	backfillFulfillment := DB.Migrator().HasTable(&Order{}) && !DB.Migrator().HasColumn(&Order{}, "fulfillment_status")
+
+	// Products from before stock was tracked would otherwise all show as
+	// sold out
+	backfillStock := DB.Migrator().HasTable(&Product{}) && !DB.Migrator().HasColumn(&Product{}, "stock")
+
+	err := DB.AutoMigrate(
 		&User{},
 		&Session{},
+		&Category{},
+		&Tag{},
 		&Product{},
+		&ProductVariant{},
+		&Address{},
+		&ShippingMethod{},
+		&TaxRate{},
+		&Coupon{},
+		&CouponRedemption{},
 		&CartItem{},
+		&StockReservation{},
 		&Order{},
 		&OrderItem{},
+		&OrderStatusChange{},
+		&Refund{},
+		&RefundItem{},
+		&WebhookEvent{},
+		&AccountToken{},
+		&RecoveryCode{},
 	)
+	if err != nil {
+		return err
+	}
+
+	if grandfatherVerified {
+		if err := DB.Model(&User{}).Where("email_verified = ?", false).Update("email_verified", true).Error; err != nil {
+			return err
+		}
+	}
+
+	// Orders placed before the status lifecycle were all marked "completed"
+	if err := DB.Model(&Order{}).Where("status = ?", "completed").Update("status", OrderStatusPaid).Error; err != nil {
+		return err
+	}
+
+	if backfillFulfillment {
+		if err := backfillFulfillmentStatus(); err != nil {
+			return err
+		}
+	}
+
+	if backfillStock {
+		quantity := initialStock()
+		result := DB.Model(&Product{}).Where("stock = 0").Update("stock", quantity)
+		if result.Error != nil {
+			return result.Error
+		}
+		log.Printf("Stock tracking enabled: gave %d existing products %d units each", result.RowsAffected, quantity)
+	}
+
+	// Full-text search index over product name and description
+	return createSearchIndex(DB)
+}
+
+// defaultInitialStock applies when INITIAL_STOCK is unset
+const defaultInitialStock = 100
+
+// initialStock returns the units on hand given to products that existed
+// before stock was tracked, from INITIAL_STOCK
+func initialStock() int {
+	value := os.Getenv("INITIAL_STOCK")
+	if value == "" {
+		return defaultInitialStock
+	}
+	quantity, err := strconv.Atoi(value)
+	if err != nil || quantity < 0 {
+		log.Printf("Invalid INITIAL_STOCK %q, using %d", value, defaultInitialStock)
+		return defaultInitialStock
+	}
+	return quantity
+}
+
+// backfillFulfillmentStatus sets each order's fulfillment status to the
+// last fulfillment status in its history, or its current status
+func backfillFulfillmentStatus() error {
+	err := DB.Exec(`UPDATE orders SET fulfillment_status = COALESCE((
+		SELECT h.to_status FROM order_status_history h
+		WHERE h.order_id = orders.id AND h.to_status IN ?
+		ORDER BY h.created_at DESC LIMIT 1), '')`, fulfillmentSteps).Error
+	if err != nil {
+		return err
+	}
+	return DB.Model(&Order{}).
+		Where("fulfillment_status = '' AND status IN ?", fulfillmentSteps).
+		Update("fulfillment_status", gorm.Expr("status")).Error
 }
 
 // seedData adds initial products to the database
@@ -70,6 +184,8 @@ func seedData() error {
 			Name:        "Premium Headphones",
 			Description: "High-quality wireless headphones with noise cancellation",
 			Price:       29900,
+			WeightGrams: 350,
+			Stock:       25,
 			ImageURL:    "https://images.unsplash.com/photo-1505740420928-5e560c06d30e?w=400",
 		},
 		{
@@ -77,6 +193,8 @@ func seedData() error {
 			Name:        "Smart Watch",
 			Description: "Fitness tracking smartwatch with heart rate monitor",
 			Price:       19900,
+			WeightGrams: 60,
+			Stock:       40,
 			ImageURL:    "https://images.unsplash.com/photo-1523275335684-37898b6baf30?w=400",
 		},
 		{
@@ -84,6 +202,8 @@ func seedData() error {
 			Name:        "Laptop Stand",
 			Description: "Ergonomic aluminum laptop stand for better posture",
 			Price:       4900,
+			WeightGrams: 1400,
+			Stock:       100,
 			ImageURL:    "https://images.unsplash.com/photo-1527864550417-7fd91fc51a46?w=400",
 		},
 		{
@@ -91,8 +211,19 @@ func seedData() error {
 			Name:        "Mechanical Keyboard",
 			Description: "RGB mechanical keyboard with Cherry MX switches",
 			Price:       12900,
+			WeightGrams: 1100,
+			Stock:       15,
 			ImageURL:    "https://images.unsplash.com/photo-1511467687858-23d96c32e4ae?w=400",
 		},
+		{
+			ID:          "5",
+			Name:        "Developer T-Shirt",
+			Description: "Soft organic cotton tee with a minimalist terminal print",
+			Price:       2500,
+			WeightGrams: 180,
+			ImageURL:    "https://images.unsplash.com/photo-1521572163474-6864f9cf17ab?w=400",
+			Variants:    seedShirtVariants(),
+		},
 	}
 
 	result := DB.Create(&products)
@@ -104,7 +235,229 @@ func seedData() error {
 	return nil
 }
 
+// seedShirtVariants builds the seeded T-shirt's size and color variants.
+// XL costs a little more than the product price, and white S starts sold
+// out so the storefront shows an unavailable option.
+func seedShirtVariants() []ProductVariant {
+	xlPrice := int64(2900)
+	var variants []ProductVariant
+	colors := []struct{ Name, Code string }{{"Black", "BLK"}, {"White", "WHT"}}
+	for _, color := range colors {
+		for i, size := range []string{"S", "M", "L", "XL"} {
+			variant := ProductVariant{
+				SKU:       fmt.Sprintf("TEE-%s-%s", color.Code, size),
+				Options:   map[string]string{"color": color.Name, "size": size},
+				Stock:     20,
+				SortOrder: len(variants),
+			}
+			if size == "XL" {
+				variant.Price = &xlPrice
+				variant.Stock = 8
+			}
+			if color.Name == "White" && i == 0 {
+				variant.Stock = 0
+			}
+			variants = append(variants, variant)
+		}
+	}
+	return variants
+}
+
+// seedCatalog adds the starter category tree and tags, and files the seeded
+// products under them
+func seedCatalog() error {
+	var count int64
+	DB.Model(&Category{}).Count(&count)
+	if count > 0 {
+		return nil
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		tree := []struct {
+			Name     string
+			Children []string
+		}{
+			{"Electronics", []string{"Audio", "Wearables"}},
+			{"Accessories", []string{"Desk Setup", "Peripherals", "Apparel"}},
+		}
+
+		categoryIDs := map[string]string{}
+		for _, root := range tree {
+			parent := Category{Name: root.Name, Slug: slugify(root.Name)}
+			if err := tx.Create(&parent).Error; err != nil {
+				return err
+			}
+			for _, name := range root.Children {
+				child := Category{Name: name, Slug: slugify(name), ParentID: &parent.ID}
+				if err := tx.Create(&child).Error; err != nil {
+					return err
+				}
+				categoryIDs[name] = child.ID
+			}
+		}
+
+		// Seeded product ID -> category and tags
+		assignments := map[string]struct {
+			Category string
+			Tags     []string
+		}{
+			"1": {"Audio", []string{"Wireless", "Bestseller"}},
+			"2": {"Wearables", []string{"Wireless", "Fitness"}},
+			"3": {"Desk Setup", []string{"Ergonomic"}},
+			"4": {"Peripherals", []string{"RGB", "Bestseller"}},
+			"5": {"Apparel", []string{"Organic"}},
+		}
+		for productID, a := range assignments {
+			var product Product
+			if err := tx.Where("id = ? AND category_id IS NULL", productID).First(&product).Error; err != nil {
+				continue
+			}
+			categoryID := categoryIDs[a.Category]
+			if err := tx.Model(&product).Update("category_id", categoryID).Error; err != nil {
+				return err
+			}
+			tags, err := findOrCreateTags(tx, a.Tags)
+			if err != nil {
+				return err
+			}
+			if err := tx.Model(&product).Association("Tags").Replace(tags); err != nil {
+				return err
+			}
+		}
+
+		log.Printf("Seeded %d categories", len(categoryIDs)+len(tree))
+		return nil
+	})
+}
+
+// seedShippingMethods adds a starter set of shipping methods, one of each kind
+func seedShippingMethods() error {
+	var count int64
+	DB.Model(&ShippingMethod{}).Count(&count)
+	if count > 0 {
+		return nil
+	}
+
+	methods := []ShippingMethod{
+		{
+			Name:        "Standard",
+			Description: "5-7 business days, free on orders over $75",
+			Kind:        ShippingFreeOver,
+			BaseRate:    599,
+			FreeOver:    7500,
+			SortOrder:   1,
+			Active:      true,
+		},
+		{
+			Name:           "Express",
+			Description:    "2-3 business days",
+			Kind:           ShippingByWeight,
+			BaseRate:       999,
+			PerKgRate:      200,
+			MaxWeightGrams: 30000,
+			SortOrder:      2,
+			Active:         true,
+		},
+		{
+			Name:        "Overnight",
+			Description: "Next business day",
+			Kind:        ShippingFlat,
+			BaseRate:    2499,
+			SortOrder:   3,
+			Active:      true,
+		},
+	}
+	if err := DB.Create(&methods).Error; err != nil {
+		return err
+	}
+
+	log.Printf("Seeded %d shipping methods", len(methods))
+	return nil
+}
+
+// seedTaxRates adds starter sales tax rates for the countries we ship to.
+// Rates change; review them before going live.
+func seedTaxRates() error {
+	var count int64
+	DB.Model(&TaxRate{}).Count(&count)
+	if count > 0 {
+		return nil
+	}
+
+	rates := []TaxRate{
+		{Name: "California sales tax", Country: "US", Region: "CA", Category: TaxStandard, Rate: 7250},
+		{Name: "New York sales tax", Country: "US", Region: "NY", Category: TaxStandard, Rate: 4000},
+		{Name: "Texas sales tax", Country: "US", Region: "TX", Category: TaxStandard, Rate: 6250},
+		{Name: "Washington sales tax", Country: "US", Region: "WA", Category: TaxStandard, Rate: 6500},
+		{Name: "GST", Country: "CA", Category: TaxStandard, Rate: 5000},
+		{Name: "GST", Country: "CA", Category: TaxReduced, Rate: 5000},
+		{Name: "HST (provincial part)", Country: "CA", Region: "ON", Category: TaxStandard, Rate: 8000},
+		{Name: "PST", Country: "CA", Region: "BC", Category: TaxStandard, Rate: 7000},
+		{Name: "QST", Country: "CA", Region: "QC", Category: TaxStandard, Rate: 9975},
+		{Name: "VAT", Country: "GB", Category: TaxStandard, Rate: 20000},
+		{Name: "VAT", Country: "GB", Category: TaxReduced, Rate: 5000},
+		{Name: "VAT", Country: "IE", Category: TaxStandard, Rate: 23000},
+		{Name: "VAT", Country: "IE", Category: TaxReduced, Rate: 13500},
+		{Name: "GST", Country: "AU", Category: TaxStandard, Rate: 10000},
+		{Name: "MwSt.", Country: "DE", Category: TaxStandard, Rate: 19000},
+		{Name: "MwSt.", Country: "DE", Category: TaxReduced, Rate: 7000},
+		{Name: "TVA", Country: "FR", Category: TaxStandard, Rate: 20000},
+		{Name: "TVA", Country: "FR", Category: TaxReduced, Rate: 5500},
+	}
+	if err := DB.Create(&rates).Error; err != nil {
+		return err
+	}
+
+	log.Printf("Seeded %d tax rates", len(rates))
+	return nil
+}
+
+// cleanupInterval is how often the server prunes expired rows
+const cleanupInterval = time.Hour
+
+// StartCleanup prunes expired sessions, lapsed stock reservations and
+// abandoned guest carts now and then every cleanupInterval, in the
+// background
+func StartCleanup() {
+	go func() {
+		ticker := time.NewTicker(cleanupInterval)
+		defer ticker.Stop()
+		for {
+			runCleanup()
+			<-ticker.C
+		}
+	}()
+}
+
+// runCleanup runs each cleanup once, logging rather than stopping on errors
+func runCleanup() {
+	jobs := []struct {
+		name string
+		run  func() error
+	}{
+		{"expired sessions", CleanupExpiredSessions},
+		{"expired stock reservations", CleanupExpiredReservations},
+		{"abandoned guest carts", CleanupAbandonedGuestCarts},
+	}
+	for _, job := range jobs {
+		if err := job.run(); err != nil {
+			log.Printf("Failed to clean up %s: %v", job.name, err)
+		}
+	}
+}
+
 // CleanupExpiredSessions removes expired JWT sessions from database
 func CleanupExpiredSessions() error {
 	return DB.Where("expires_at < ?", time.Now()).Delete(&Session{}).Error
 }
+
+// CleanupExpiredReservations removes checkout stock holds that have lapsed
+func CleanupExpiredReservations() error {
+	return DB.Where("expires_at < ?", time.Now()).Delete(&StockReservation{}).Error
+}
+
+// CleanupAbandonedGuestCarts removes guest cart rows untouched for longer
+// than the guest cookie lifetime
+func CleanupAbandonedGuestCarts() error {
+	return DB.Where("guest_id <> '' AND updated_at < ?", time.Now().Add(-guestCartTTL)).Delete(&CartItem{}).Error
+}
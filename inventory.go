@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// reservationTTL is how long stock is held once a user enters checkout
+const reservationTTL = 15 * time.Minute
+
+// ErrInsufficientStock is returned when a product cannot cover a quantity
+var ErrInsufficientStock = errors.New("insufficient stock")
+
+// reservedByOthers is the SQL fragment summing live holds from other users
+// on a product's own stock. Arguments: product ID, user ID.
+const reservedByOthers = `(SELECT COALESCE(SUM(quantity), 0) FROM stock_reservations
+	WHERE product_id = ? AND variant_id IS NULL AND user_id <> ? AND expires_at > NOW())`
+
+// variantReservedByOthers is reservedByOthers for a variant's stock.
+// Arguments: variant ID, user ID.
+const variantReservedByOthers = `(SELECT COALESCE(SUM(quantity), 0) FROM stock_reservations
+	WHERE variant_id = ? AND user_id <> ? AND expires_at > NOW())`
+
+// stockRow locates the stock for a product, or for one of its variants when
+// variantID is set: the table, row ID and reservation fragment to use
+func stockRow(productID string, variantID *string) (table, id, reserved string) {
+	if variantID != nil {
+		return "product_variants", *variantID, variantReservedByOthers
+	}
+	return "products", productID, reservedByOthers
+}
+
+// availableStock returns units of a product or variant that userID may
+// still buy: stock on hand minus live reservations held by other users
+func availableStock(db *gorm.DB, productID string, variantID *string, userID string) (int, error) {
+	table, id, reserved := stockRow(productID, variantID)
+
+	var available int
+	err := db.Raw("SELECT stock - "+reserved+" FROM "+table+" WHERE id = ?",
+		id, userID, id).Scan(&available).Error
+	if err != nil {
+		return 0, err
+	}
+	if available < 0 {
+		available = 0
+	}
+	return available, nil
+}
+
+// checkCartStock verifies every cart line can be fulfilled
+func checkCartStock(db *gorm.DB, userID string, cartItems []CartItem) error {
+	for _, item := range cartItems {
+		available, err := availableStock(db, item.ProductID, item.VariantID, userID)
+		if err != nil {
+			return err
+		}
+		if item.Quantity > available {
+			return stockError(item.DisplayName(), available)
+		}
+	}
+	return nil
+}
+
+// reserveCart replaces the user's reservations with holds covering their
+// current cart, failing if any line exceeds the available stock
+func reserveCart(userID string, cartItems []CartItem) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := releaseReservations(tx, userID); err != nil {
+			return err
+		}
+
+		if err := checkCartStock(tx, userID, cartItems); err != nil {
+			return err
+		}
+
+		expiresAt := time.Now().Add(reservationTTL)
+		for _, item := range cartItems {
+			reservation := StockReservation{
+				UserID:    userID,
+				ProductID: item.ProductID,
+				VariantID: item.VariantID,
+				Quantity:  item.Quantity,
+				ExpiresAt: expiresAt,
+			}
+			if err := tx.Create(&reservation).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// releaseReservations drops every stock hold owned by the user
+func releaseReservations(tx *gorm.DB, userID string) error {
+	return tx.Where("user_id = ?", userID).Delete(&StockReservation{}).Error
+}
+
+// decrementStock atomically removes purchased units. The conditional update
+// only succeeds while stock, net of other users' live reservations, still
+// covers the quantity, so concurrent checkouts cannot oversell.
+func decrementStock(tx *gorm.DB, userID string, cartItems []CartItem) error {
+	for _, item := range cartItems {
+		table, id, reserved := stockRow(item.ProductID, item.VariantID)
+		result := tx.Exec("UPDATE "+table+" SET stock = stock - ?, updated_at = NOW() WHERE id = ? AND stock - "+reserved+" >= ?",
+			item.Quantity, id, id, userID, item.Quantity)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			available, _ := availableStock(tx, item.ProductID, item.VariantID, userID)
+			return stockError(item.DisplayName(), available)
+		}
+	}
+	return releaseReservations(tx, userID)
+}
+
+// restock puts units of a product or variant back on hand. A negative
+// quantity takes them out again, never below zero.
+func restock(tx *gorm.DB, productID string, variantID *string, quantity int) error {
+	table, id, _ := stockRow(productID, variantID)
+	return tx.Exec("UPDATE "+table+" SET stock = GREATEST(stock + ?, 0), updated_at = NOW() WHERE id = ?",
+		quantity, id).Error
+}
+
+// StockError describes a shortfall in terms suitable for the customer
+type StockError struct {
+	ProductName string
+	Available   int
+}
+
+func (e *StockError) Error() string {
+	if e.Available <= 0 {
+		return fmt.Sprintf("%s is out of stock", e.ProductName)
+	}
+	return fmt.Sprintf("Only %d of %s left in stock", e.Available, e.ProductName)
+}
+
+// Is lets callers match any StockError with errors.Is(err, ErrInsufficientStock)
+func (e *StockError) Is(target error) bool {
+	return target == ErrInsufficientStock
+}
+
+func stockError(productName string, available int) error {
+	return &StockError{ProductName: productName, Available: available}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// EmailMessage is a plain-text transactional email
+type EmailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer abstracts how transactional email is delivered
+type Mailer interface {
+	// Name identifies the backend ("log", "file", "smtp")
+	Name() string
+	// Send delivers one message
+	Send(msg EmailMessage) error
+}
+
+// Mail is the mailer selected by MAIL_BACKEND
+var Mail Mailer
+
+// InitMailer selects the mail backend from the environment. There is no
+// default: emails carry live sign-in links, so writing them to the log has
+// to be chosen on purpose.
+func InitMailer() {
+	mailer, err := newMailer(os.Getenv("MAIL_BACKEND"))
+	if err != nil {
+		log.Fatalf("Failed to configure mail: %v", err)
+	}
+	Mail = mailer
+	log.Printf("Mail backend: %s", Mail.Name())
+}
+
+func newMailer(name string) (Mailer, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "":
+		return nil, fmt.Errorf("MAIL_BACKEND is required (\"log\" for development, \"file\" or \"smtp\")")
+	case "log":
+		return logMailer{}, nil
+	case "file":
+		return newFileMailer()
+	case "smtp":
+		return newSMTPMailer()
+	default:
+		return nil, fmt.Errorf("unknown MAIL_BACKEND %q (expected \"log\", \"file\" or \"smtp\")", name)
+	}
+}
+
+// emailLink returns an absolute link to path on this site, for emails.
+// APP_URL is the site's public address.
+func emailLink(path string) string {
+	base := strings.TrimRight(os.Getenv("APP_URL"), "/")
+	if base == "" {
+		port := os.Getenv("PORT")
+		if port == "" {
+			port = "8080"
+		}
+		base = "http://localhost:" + port
+	}
+	return base + path
+}
+
+// sendEmail delivers a message in the background; failures are logged since
+// email is never worth failing the request that triggered it
+func sendEmail(msg EmailMessage) {
+	go func() {
+		if err := Mail.Send(msg); err != nil {
+			log.Printf("Failed to send %q to %s: %v", msg.Subject, msg.To, err)
+		}
+	}()
+}
+
+// logMailer writes messages to the application log, for development only:
+// password reset and verification links end up in the log in full
+type logMailer struct{}
+
+func (logMailer) Name() string { return "log" }
+
+func (logMailer) Send(msg EmailMessage) error {
+	log.Printf("Email to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// fileMailer writes each message to its own .eml file in MAIL_DIR, for
+// development and tests where links in emails need to be followed
+type fileMailer struct {
+	dir string
+}
+
+func newFileMailer() (*fileMailer, error) {
+	dir := os.Getenv("MAIL_DIR")
+	if dir == "" {
+		dir = "mail"
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create MAIL_DIR %q: %w", dir, err)
+	}
+	return &fileMailer{dir: dir}, nil
+}
+
+func (m *fileMailer) Name() string { return "file" }
+
+func (m *fileMailer) Send(msg EmailMessage) error {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(suffix) + ".eml"
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "To: %s\n", headerValue(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\n", headerValue(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\n\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString(msg.Body)
+
+	path := filepath.Join(m.dir, name)
+	if err := os.WriteFile(path, []byte(b.String()), 0o600); err != nil {
+		return err
+	}
+	log.Printf("Email to %s written to %s", msg.To, path)
+	return nil
+}
+
+// smtpMailer delivers through an SMTP relay
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+	from *mail.Address
+}
+
+func newSMTPMailer() (*smtpMailer, error) {
+	host := os.Getenv("SMTP_HOST")
+	from := os.Getenv("MAIL_FROM")
+	if host == "" || from == "" {
+		return nil, fmt.Errorf("SMTP_HOST and MAIL_FROM are required for the smtp mail backend")
+	}
+
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAIL_FROM %q: %w", from, err)
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+
+	m := &smtpMailer{
+		addr: net.JoinHostPort(host, port),
+		from: sender,
+	}
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		m.auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return m, nil
+}
+
+func (m *smtpMailer) Name() string { return "smtp" }
+
+func (m *smtpMailer) Send(msg EmailMessage) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", m.from.String())
+	fmt.Fprintf(&b, "To: %s\r\n", headerValue(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", headerValue(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	return smtp.SendMail(m.addr, m.auth, m.from.Address, []string{msg.To}, []byte(b.String()))
+}
+
+// headerValue strips line breaks so values cannot inject extra headers
+func headerValue(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
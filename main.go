@@ -1,15 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
-	"time"
 
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
@@ -26,6 +26,18 @@ func main() {
 	// Initialize database
 	InitDatabase()
 
+	// Run a management command instead of the server, e.g. `go run . create-admin`
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
+	// Select payment provider (Square or the offline fake)
+	InitPayments()
+	InitMailer()
+
+	// Prune expired sessions, reservations and guest carts hourly
+	StartCleanup()
+
 	// Get port from environment variable, default to 8080
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -36,20 +48,69 @@ func main() {
 	http.HandleFunc("/", homeHandler)
 	http.HandleFunc("/register", registerHandler)
 	http.HandleFunc("/login", loginHandler)
+	http.HandleFunc("/login/2fa", loginTwoFactorHandler)
+	http.HandleFunc("/forgot-password", forgotPasswordHandler)
+	http.HandleFunc("/reset-password", resetPasswordHandler)
+	http.HandleFunc("/verify", verifyEmailHandler)
+	http.HandleFunc("/verify/resend", authMiddleware(resendVerificationHandler))
+	http.HandleFunc("/search", searchHandler)
+	http.HandleFunc("/api/products", productsAPIHandler)
+
+	// Payment processor webhooks (authenticated by signature)
+	http.HandleFunc("/webhooks/square", squareWebhookHandler)
+
+	// Cart routes (logged-in users or guests)
+	http.HandleFunc("/cart", cartHandler)
+	http.HandleFunc("/add-to-cart", addToCartHandler)
+	http.HandleFunc("/remove-from-cart", removeFromCartHandler)
+	http.HandleFunc("/cart/coupon", cartCouponHandler)
 
 	// Protected routes (require authentication)
 	http.HandleFunc("/logout", logoutHandler)
+	http.HandleFunc("/logout-all", authMiddleware(logoutAllHandler))
+	http.HandleFunc("/token/refresh", tokenRefreshHandler)
 	http.HandleFunc("/profile", authMiddleware(profileHandler))
 	http.HandleFunc("/update-password", authMiddleware(updatePasswordHandler))
-	http.HandleFunc("/cart", authMiddleware(cartHandler))
-	http.HandleFunc("/add-to-cart", authMiddleware(addToCartHandler))
-	http.HandleFunc("/remove-from-cart", authMiddleware(removeFromCartHandler))
+	http.HandleFunc("/2fa/setup", authMiddleware(twoFactorSetupHandler))
+	http.HandleFunc("/2fa/enable", authMiddleware(twoFactorEnableHandler))
+	http.HandleFunc("/2fa/disable", authMiddleware(twoFactorDisableHandler))
+	http.HandleFunc("/2fa/recovery-codes", authMiddleware(recoveryCodesHandler))
+	http.HandleFunc("/addresses", authMiddleware(addressesHandler))
+	http.HandleFunc("/addresses/delete", authMiddleware(deleteAddressHandler))
+	http.HandleFunc("/addresses/default", authMiddleware(defaultAddressHandler))
+	http.HandleFunc("/api/addresses", authMiddleware(addressesAPIHandler))
 	http.HandleFunc("/checkout", authMiddleware(checkoutHandler))
+	http.HandleFunc("/checkout/totals", authMiddleware(checkoutTotalsHandler))
 	http.HandleFunc("/process-payment", authMiddleware(processPaymentHandler))
 	http.HandleFunc("/order-confirmation", authMiddleware(orderConfirmationHandler))
+	http.HandleFunc("/orders", authMiddleware(ordersHandler))
+	http.HandleFunc("/orders/detail", authMiddleware(orderDetailHandler))
+	http.HandleFunc("/api/orders", authMiddleware(ordersAPIHandler))
+	http.HandleFunc("/api/orders/detail", authMiddleware(orderDetailAPIHandler))
+	http.HandleFunc("/orders/cancel", authMiddleware(cancelOrderHandler))
+	http.HandleFunc("/api/orders/cancel", authMiddleware(cancelOrderAPIHandler))
+
+	// Admin routes (require a role granting the permission)
+	http.HandleFunc("/admin/products", requirePermission(PermManageProducts, adminProductsHandler))
+	http.HandleFunc("/admin/products/edit", requirePermission(PermManageProducts, adminProductFormHandler))
+	http.HandleFunc("/admin/products/archive", requirePermission(PermManageProducts, adminArchiveProductHandler))
+	http.HandleFunc("/api/admin/products", requirePermission(PermManageProducts, adminProductsAPIHandler))
+	http.HandleFunc("/api/admin/products/variants", requirePermission(PermManageProducts, adminVariantsAPIHandler))
+	http.HandleFunc("/api/admin/categories", requirePermission(PermManageProducts, adminCategoriesAPIHandler))
+	http.HandleFunc("/api/admin/shipping-methods", requirePermission(PermManageProducts, adminShippingMethodsAPIHandler))
+	http.HandleFunc("/api/admin/tax-rates", requirePermission(PermManageProducts, adminTaxRatesAPIHandler))
+	http.HandleFunc("/api/admin/coupons", requirePermission(PermManageProducts, adminCouponsAPIHandler))
+	http.HandleFunc("/api/admin/users/role", requirePermission(PermManageUsers, adminUserRoleHandler))
+	http.HandleFunc("/admin/orders", requirePermission(PermViewAllOrders, adminOrdersHandler))
+	http.HandleFunc("/admin/orders/detail", requirePermission(PermViewAllOrders, adminOrderHandler))
+	http.HandleFunc("/admin/orders/refund", requirePermission(PermRefundOrders, adminRefundOrderHandler))
+	http.HandleFunc("/admin/orders/status", requirePermission(PermManageOrders, adminOrderStatusHandler))
+	http.HandleFunc("/api/admin/orders", requirePermission(PermViewAllOrders, adminOrdersAPIHandler))
+	http.HandleFunc("/api/admin/orders/refund", requirePermission(PermRefundOrders, adminRefundOrderAPIHandler))
+	http.HandleFunc("/api/admin/orders/status", requirePermission(PermManageOrders, adminOrderStatusAPIHandler))
 
 	log.Printf("Server starting on http://localhost:%s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	log.Fatal(http.ListenAndServe(":"+port, refreshSessionMiddleware(http.DefaultServeMux)))
 }
 
 func homeHandler(w http.ResponseWriter, r *http.Request) {
@@ -66,34 +127,63 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get products from database
-	var products []Product
-	DB.Find(&products)
+	// Get one page of products matching the browse filters
+	filter := parseCatalogFilter(r)
+	pageReq := parseCatalogPage(r)
+	page, err := loadCatalogPage(DB.Preload("Variants", liveVariants), filter, pageReq)
+	if errors.Is(err, ErrInvalidCursor) {
+		http.Error(w, "Invalid page cursor", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load products: %v", err)
+		http.Error(w, "Failed to load products", http.StatusInternalServerError)
+		return
+	}
+
+	var nextURL string
+	if page.NextCursor != "" {
+		nextURL = filter.pageURL(page.NextCursor)
+	}
 
-	// Check if user is logged in
-	user, _ := getCurrentUser(r)
+	// HTMX filter changes only need the product grid, and "load more"
+	// requests only the next batch of cards
+	if r.Header.Get("HX-Request") == "true" {
+		partial := "product-grid"
+		if pageReq.Cursor != "" {
+			partial = "product-cards"
+		}
+		data := map[string]interface{}{
+			"Products": page.Products,
+			"Filter":   filter,
+			"NextURL":  nextURL,
+		}
+		if err := tmpl.ExecuteTemplate(w, partial, data); err != nil {
+			log.Printf("Template execution error: %v", err)
+		}
+		return
+	}
 
-	// Get cart count for logged-in users
+	// Get cart count for the logged-in user or guest
 	var cartCount int64
-	if user != nil {
-		DB.Model(&CartItem{}).Where("user_id = ?", user.ID).Count(&cartCount)
+	owner, user, hasCart := currentCart(w, r, false)
+	if hasCart {
+		cartCount = countCart(owner)
 	}
 
 	data := map[string]interface{}{
-		"Products":  products,
-		"CartCount": cartCount,
-		"User":      user,
+		"Products":   page.Products,
+		"NextURL":    nextURL,
+		"CartCount":  cartCount,
+		"User":       user,
+		"Filter":     filter,
+		"Categories": loadCategoryTree(),
+		"Tags":       loadTags(),
 	}
 	tmpl.Execute(w, data)
 }
 
 func cartHandler(w http.ResponseWriter, r *http.Request) {
-	user, err := getCurrentUser(r)
-	if err != nil {
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
-		return
-	}
-
 	// Create template with custom function
 	tmpl := template.New("cart.html").Funcs(template.FuncMap{
 		"divf": func(a, b int64) float64 {
@@ -101,34 +191,60 @@ func cartHandler(w http.ResponseWriter, r *http.Request) {
 		},
 	})
 
-	tmpl, err = tmpl.ParseFiles("templates/cart.html")
+	tmpl, err := tmpl.ParseFiles("templates/cart.html")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		log.Printf("Template error: %v", err)
 		return
 	}
 
+	data, err := cartPageData(w, r, readCouponCookie(r))
+	if err != nil {
+		log.Printf("Failed to price cart: %v", err)
+		http.Error(w, "Failed to load cart", http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		log.Printf("Template execution error: %v", err)
+	}
+}
+
+// cartPageData gathers what the cart page shows: the items priced with the
+// coupon in couponCode and, for signed-in users, tax estimated for their
+// default address
+func cartPageData(w http.ResponseWriter, r *http.Request, couponCode string) (map[string]interface{}, error) {
+	owner, user, hasCart := currentCart(w, r, false)
+
 	// Get cart items from database with product info
 	var cartItems []CartItem
-	DB.Preload("Product").Where("user_id = ?", user.ID).Find(&cartItems)
-
-	// Calculate total
-	var total int64
-	for _, item := range cartItems {
-		total += item.Product.Price * int64(item.Quantity)
+	if hasCart {
+		cartItems = loadCart(owner)
 	}
 
-	data := map[string]interface{}{
-		"CartItems": cartItems,
-		"Total":     total,
-		"CartCount": len(cartItems),
-		"User":      user,
+	pricing := pricingOptions{CouponCode: couponCode}
+	if user != nil {
+		pricing.UserID = user.ID
+		pricing.ShipTo, _ = defaultAddress(user.ID)
 	}
 
-	err = tmpl.Execute(w, data)
+	// A coupon that no longer fits the cart stays remembered, since adding
+	// items may qualify it again, but is not applied
+	priced, err := priceCart(cartItems, pricing)
 	if err != nil {
-		log.Printf("Template execution error: %v", err)
-	}
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"Pricing":     priced,
+		"CouponCode":  couponCode,
+		"CouponError": priced.CouponError,
+		"TaxAddress":  pricing.ShipTo,
+		"CartCount":   len(cartItems),
+		"User":        user,
+		"Error":       r.URL.Query().Get("error"),
+	}, nil
 }
 
 func addToCartHandler(w http.ResponseWriter, r *http.Request) {
@@ -137,13 +253,6 @@ func addToCartHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := getCurrentUser(r)
-	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Not authenticated"})
-		return
-	}
-
 	productID := r.FormValue("product_id")
 	quantityStr := r.FormValue("quantity")
 	quantity, _ := strconv.Atoi(quantityStr)
@@ -153,14 +262,53 @@ func addToCartHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Check if product exists
 	var product Product
-	if err := DB.Where("id = ?", productID).First(&product).Error; err != nil {
+	if err := DB.Preload("Variants", liveVariants).Where("id = ? AND archived_at IS NULL", productID).First(&product).Error; err != nil {
 		http.Error(w, "Product not found", http.StatusNotFound)
 		return
 	}
 
+	// Products with variants are bought one variant at a time
+	var variantID *string
+	line := CartItem{Product: product}
+	if product.HasVariants() {
+		variant, ok := product.variant(r.FormValue("variant_id"))
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "Please choose an option for " + product.Name,
+			})
+			return
+		}
+		variantID = &variant.ID
+		line.Variant = variant
+	}
+
+	// Guests get a cart on their first add
+	owner, _, _ := currentCart(w, r, true)
+
 	// Check if item already in cart
 	var existingItem CartItem
-	result := DB.Where("user_id = ? AND product_id = ?", user.ID, productID).First(&existingItem)
+	result := cartLine(owner.scope(DB), productID, variantID).First(&existingItem)
+
+	// Make sure the new cart quantity can be fulfilled
+	available, err := availableStock(DB, productID, variantID, owner.reservationID())
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Server error"})
+		return
+	}
+	if existingItem.Quantity+quantity > available {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   stockError(line.DisplayName(), available-existingItem.Quantity).Error(),
+		})
+		return
+	}
 
 	if result.Error == nil {
 		// Update quantity
@@ -169,16 +317,17 @@ func addToCartHandler(w http.ResponseWriter, r *http.Request) {
 	} else {
 		// Create new cart item
 		newItem := CartItem{
-			UserID:    user.ID,
+			UserID:    owner.UserID,
+			GuestID:   owner.GuestID,
 			ProductID: productID,
+			VariantID: variantID,
 			Quantity:  quantity,
 		}
 		DB.Create(&newItem)
 	}
 
 	// Get updated cart count
-	var cartCount int64
-	DB.Model(&CartItem{}).Where("user_id = ?", user.ID).Count(&cartCount)
+	cartCount := countCart(owner)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -193,16 +342,20 @@ func removeFromCartHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := getCurrentUser(r)
-	if err != nil {
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	owner, _, hasCart := currentCart(w, r, false)
+	if !hasCart {
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
 		return
 	}
 
 	productID := r.FormValue("product_id")
-	
+	var variantID *string
+	if id := r.FormValue("variant_id"); id != "" {
+		variantID = &id
+	}
+
 	// Delete cart item
-	DB.Where("user_id = ? AND product_id = ?", user.ID, productID).Delete(&CartItem{})
+	cartLine(owner.scope(DB), productID, variantID).Delete(&CartItem{})
 
 	http.Redirect(w, r, "/cart", http.StatusSeeOther)
 }
@@ -214,15 +367,32 @@ func checkoutHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := checkCanCheckout(user); err != nil {
+		http.Redirect(w, r, "/cart?error="+url.QueryEscape(emailNotVerifiedMessage), http.StatusSeeOther)
+		return
+	}
+
 	// Get cart items
 	var cartItems []CartItem
-	DB.Preload("Product").Where("user_id = ?", user.ID).Find(&cartItems)
+	DB.Preload("Product").Preload("Variant").Where("user_id = ?", user.ID).Find(&cartItems)
 
 	if len(cartItems) == 0 {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 
+	// Hold the cart's stock while the user completes payment
+	if err := reserveCart(user.ID, cartItems); err != nil {
+		log.Printf("Stock reservation failed: %v", err)
+		var stockErr *StockError
+		if errors.As(err, &stockErr) {
+			http.Redirect(w, r, "/cart?error="+url.QueryEscape(stockErr.Error()), http.StatusSeeOther)
+			return
+		}
+		http.Error(w, "Failed to reserve stock", http.StatusInternalServerError)
+		return
+	}
+
 	// Create template with custom function
 	tmpl := template.New("checkout.html").Funcs(template.FuncMap{
 		"divf": func(a, b int64) float64 {
@@ -237,17 +407,39 @@ func checkoutHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Calculate total
-	var total int64
-	for _, item := range cartItems {
-		total += item.Product.Price * int64(item.Quantity)
+	// Saved addresses to ship to, default first
+	addresses, err := listAddresses(user.ID)
+	if err != nil {
+		log.Printf("Failed to load addresses: %v", err)
+	}
+
+	// Tax follows the preselected address until the customer picks another
+	var taxAddress PostalAddress
+	if len(addresses) > 0 {
+		taxAddress = addresses[0].PostalAddress
+	}
+
+	// Price the cart with the first shipping method preselected and the
+	// coupon from the cart; a coupon that no longer fits is explained and left off
+	priced, err := priceCart(cartItems, pricingOptions{
+		UserID:     user.ID,
+		CouponCode: readCouponCookie(r),
+		ShipTo:     taxAddress,
+		Shipping:   true,
+	})
+	if err != nil {
+		log.Printf("Failed to price cart: %v", err)
+		http.Error(w, "Failed to price order", http.StatusInternalServerError)
+		return
 	}
 
 	data := map[string]interface{}{
-		"CartItems":        cartItems,
-		"Total":            total,
+		"Pricing":          priced,
+		"Addresses":        addresses,
+		"Countries":        countryOptions(),
 		"SquareAppID":      os.Getenv("SQUARE_APPLICATION_ID"),
 		"SquareLocationID": os.Getenv("SQUARE_LOCATION_ID"),
+		"PaymentProvider":  Payments.Name(),
 		"User":             user,
 	}
 
@@ -270,10 +462,26 @@ func processPaymentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := checkCanCheckout(user); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   emailNotVerifiedMessage,
+		})
+		return
+	}
+
 	var requestBody struct {
-		SourceID string `json:"sourceId"`
-		Email    string `json:"email"`
-		Name     string `json:"name"`
+		SourceID    string         `json:"sourceId"`
+		Email       string         `json:"email"`
+		Name        string         `json:"name"`
+		AddressID   string         `json:"addressId"`   // a saved address, or
+		Address     *PostalAddress `json:"address"`     // one entered at checkout
+		SaveAddress bool           `json:"saveAddress"` // add the entered address to the address book
+
+		ShippingMethodID string `json:"shippingMethodId"`
+		CouponCode       string `json:"couponCode"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
@@ -281,9 +489,20 @@ func processPaymentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	shipTo, err := checkoutAddress(user.ID, requestBody.AddressID, requestBody.Address)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
 	// Get cart items
 	var cartItems []CartItem
-	DB.Preload("Product").Where("user_id = ?", user.ID).Find(&cartItems)
+	DB.Preload("Product").Preload("Variant").Where("user_id = ?", user.ID).Find(&cartItems)
 
 	if len(cartItems) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
@@ -291,140 +510,122 @@ func processPaymentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Calculate total
-	var total int64
-	for _, item := range cartItems {
-		total += item.Product.Price * int64(item.Quantity)
-	}
-
-	// Create payment with Square using direct HTTP API call
-	idempotencyKey := uuid.New().String()
-	locationID := os.Getenv("SQUARE_LOCATION_ID")
-	accessToken := os.Getenv("SQUARE_ACCESS_TOKEN")
-	environment := os.Getenv("SQUARE_ENVIRONMENT")
-
-	// Determine API endpoint based on environment
-	apiURL := "https://connect.squareup.com/v2/payments"
-	if environment == "sandbox" {
-		apiURL = "https://connect.squareupsandbox.com/v2/payments"
-	}
-
-	// Create payment request body
-	paymentBody := map[string]interface{}{
-		"source_id":       requestBody.SourceID,
-		"idempotency_key": idempotencyKey,
-		"amount_money": map[string]interface{}{
-			"amount":   total,
-			"currency": "USD",
-		},
-		"location_id": locationID,
-	}
-
-	if requestBody.Email != "" {
-		paymentBody["buyer_email_address"] = requestBody.Email
-	}
-	if requestBody.Name != "" {
-		paymentBody["note"] = fmt.Sprintf("Order for %s", requestBody.Name)
-	}
-
-	// Marshal to JSON
-	jsonBody, err := json.Marshal(paymentBody)
+	// Price the order exactly as checkout showed it. The coupon and shipping
+	// method are validated here, not trusted from the page, before the
+	// amount to charge is worked out.
+	priced, err := priceCart(cartItems, pricingOptions{
+		UserID:           user.ID,
+		CouponCode:       requestBody.CouponCode,
+		ShipTo:           shipTo,
+		Shipping:         true,
+		ShippingMethodID: requestBody.ShippingMethodID,
+		Strict:           true,
+	})
 	if err != nil {
-		log.Printf("JSON marshal error: %v", err)
+		status := http.StatusBadRequest
+		message := err.Error()
+		var couponErr *CouponError
+		switch {
+		case errors.Is(err, ErrShippingUnavailable):
+			message = "Please choose an available shipping method"
+		case errors.As(err, &couponErr):
+			// The reason is meant for the customer
+		default:
+			log.Printf("Failed to price order: %v", err)
+			status = http.StatusInternalServerError
+			message = "Failed to price order"
+		}
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(status)
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
-			"error":   "Internal error",
+			"error":   message,
 		})
 		return
 	}
 
-	// Create HTTP request
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(jsonBody))
-	if err != nil {
-		log.Printf("Request creation error: %v", err)
+	// Fail fast before touching the card if anything sold out
+	if err := checkCartStock(DB, user.ID, cartItems); err != nil {
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusConflict)
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
-			"error":   "Internal error",
+			"error":   err.Error(),
 		})
 		return
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-	req.Header.Set("Square-Version", "2024-12-18")
-
-	// Make API call
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	// Authorize the payment; it is captured once the order is safely recorded
+	payment, err := Payments.Authorize(PaymentRequest{
+		SourceID:       requestBody.SourceID,
+		IdempotencyKey: uuid.New().String(),
+		Amount:         priced.Total,
+		Currency:       "USD",
+		BuyerEmail:     requestBody.Email,
+		Note:           orderNote(requestBody.Name),
+	})
 	if err != nil {
-		log.Printf("Payment API error: %v", err)
+		log.Printf("Payment failed: %v", err)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
-			"error":   "Payment failed: " + err.Error(),
+			"error":   "Payment failed",
 		})
 		return
 	}
-	defer resp.Body.Close()
+	paymentID := payment.PaymentID
 
-	// Parse response
-	var apiResponse map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&apiResponse); err != nil {
-		log.Printf("Response decode error: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "Internal error",
-		})
-		return
-	}
+	// Record the order, taking the lines out of the cart, then capture
+	order, err := placeOrder(user, priced, shipTo, payment)
+	if err != nil {
+		log.Printf("Order placement failed for payment %s: %v", paymentID, err)
+		status := http.StatusInternalServerError
+		message := "Failed to place order."
+		var stockErr *StockError
+		var couponErr *CouponError
+		switch {
+		case errors.As(err, &stockErr):
+			status = http.StatusConflict
+			message = stockErr.Error() + "."
+		case errors.As(err, &couponErr):
+			status = http.StatusConflict
+			message = couponErr.Error() + "."
+		case errors.Is(err, ErrCartChanged):
+			status = http.StatusConflict
+			message = "Your cart changed while you were checking out. Please review it and try again."
+		}
+
+		// Tell the customer where their money is
+		switch {
+		case errors.Is(err, ErrPaymentRefunded):
+			message += " Your payment has been refunded."
+		case errors.Is(err, ErrPaymentNotRefunded):
+			message += " Please contact us so we can refund your payment."
+		default:
+			message += " Your card has not been charged."
+		}
 
-	// Check for errors
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Payment failed: %+v", apiResponse)
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(status)
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
-			"error":   "Payment failed",
+			"error":   message,
 		})
 		return
 	}
 
-	// Extract payment ID
-	payment := apiResponse["payment"].(map[string]interface{})
-	paymentID := payment["id"].(string)
-
-	// Create order in database
-	order := Order{
-		ID:        uuid.New().String(),
-		UserID:    user.ID,
-		Total:     total,
-		Status:    "completed",
-		PaymentID: paymentID,
-		CreatedAt: time.Now(),
-	}
-	DB.Create(&order)
-
-	// Create order items
-	for _, item := range cartItems {
-		orderItem := OrderItem{
-			OrderID:   order.ID,
-			ProductID: item.ProductID,
-			Quantity:  item.Quantity,
-			Price:     item.Product.Price,
+	// Remember a newly entered address if asked; the order already has its copy
+	if requestBody.SaveAddress && requestBody.AddressID == "" {
+		address := &Address{UserID: user.ID, PostalAddress: shipTo}
+		if err := saveAddress(address, false); err != nil {
+			log.Printf("Failed to save address for user %s: %v", user.ID, err)
 		}
-		DB.Create(&orderItem)
 	}
 
-	// Clear user's cart
-	DB.Where("user_id = ?", user.ID).Delete(&CartItem{})
+	if priced.Discount.CouponID != "" {
+		clearCouponCookie(w)
+	}
 
 	// Return success
 	w.Header().Set("Content-Type", "application/json")
@@ -436,42 +637,13 @@ func processPaymentHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func orderConfirmationHandler(w http.ResponseWriter, r *http.Request) {
-	user, err := getCurrentUser(r)
-	if err != nil {
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
-		return
-	}
-
-	orderID := r.URL.Query().Get("id")
-
-	// Get order from database
-	var order Order
-	result := DB.Preload("Items.Product").Where("id = ? AND user_id = ?", orderID, user.ID).First(&order)
-	if result.Error != nil {
-		http.Error(w, "Order not found", http.StatusNotFound)
-		return
-	}
-
-	tmpl := template.New("order-confirmation.html").Funcs(template.FuncMap{
-		"divf": func(a, b int64) float64 {
-			return float64(a) / float64(b)
-		},
-	})
-
-	tmpl, err = tmpl.ParseFiles("templates/order-confirmation.html")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	renderOrderPage(w, r, true)
+}
 
-	data := map[string]interface{}{
-		"ID":        order.ID,
-		"Items":     order.Items,
-		"Total":     order.Total,
-		"Status":    order.Status,
-		"CreatedAt": order.CreatedAt,
-		"User":      user,
+// orderNote builds the note attached to a payment
+func orderNote(name string) string {
+	if name == "" {
+		return ""
 	}
-
-	tmpl.Execute(w, data)
-}
\ No newline at end of file
+	return fmt.Sprintf("Order for %s", name)
+}
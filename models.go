@@ -1,6 +1,8 @@
 package main
 
 import (
+	"sort"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
@@ -12,71 +14,491 @@ type User struct {
 	Email        string `gorm:"unique;not null"`
 	PasswordHash string `gorm:"not null"`
 	Name         string `gorm:"not null"`
+	Role         string `gorm:"not null;default:customer"`
 	CreatedAt    time.Time
 	UpdatedAt    time.Time
+
+	EmailVerified bool `gorm:"not null;default:false"` // set once the user follows the emailed link
+
+	TOTPSecret   string `gorm:"column:totp_secret" json:"-"`                       // base32 authenticator key, kept while enrolling and once enabled
+	TOTPEnabled  bool   `gorm:"column:totp_enabled;not null;default:false"`        // sign in needs a code from the authenticator app
+	TOTPLastStep int64  `gorm:"column:totp_last_step;not null;default:0" json:"-"` // time step of the last accepted code, so codes can't be replayed
 }
 
-// Session represents a JWT session (optional - for token blacklisting)
+// User roles
+const (
+	RoleCustomer = "customer"
+	RoleSupport  = "support"
+	RoleAdmin    = "admin"
+)
+
+// Session is one refresh token of a login. Access tokens name their session
+// in the jti claim and are only accepted while it is live, so deleting
+// sessions signs users out server-side. Refreshing replaces the session
+// with a new one in the same family (see sessions.go).
 type Session struct {
-	ID        string    `gorm:"primaryKey"`
-	UserID    string    `gorm:"not null;index"`
-	Token     string    `gorm:"unique;not null"`
-	ExpiresAt time.Time `gorm:"not null;index"`
+	ID               string     `gorm:"primaryKey"`
+	UserID           string     `gorm:"not null;index"`
+	FamilyID         string     `gorm:"not null;index"`       // shared by every session refreshed from one login
+	RefreshTokenHash string     `gorm:"uniqueIndex;not null"` // SHA-256 of the refresh token
+	ExpiresAt        time.Time  `gorm:"not null;index"`       // when the refresh token lapses
+	RotatedAt        *time.Time `gorm:"index"`                // set once exchanged for a new session
+	CreatedAt        time.Time
+}
+
+// Account token purposes
+const (
+	TokenPasswordReset = "password_reset"
+	TokenVerifyEmail   = "verify_email"
+	TokenTwoFactor     = "two_factor_login"
+)
+
+// AccountToken is a single-use secret handed to a user, such as a password
+// reset link or a sign in waiting for its two-factor code. Only its hash is
+// stored.
+type AccountToken struct {
+	ID        string     `gorm:"primaryKey"`
+	UserID    string     `gorm:"not null;index"`
+	Purpose   string     `gorm:"not null;index"`
+	TokenHash string     `gorm:"uniqueIndex;not null"` // SHA-256 of the token
+	ExpiresAt time.Time  `gorm:"not null;index"`
+	UsedAt    *time.Time // set once redeemed, or when superseded by a newer token
+	CreatedAt time.Time
+
+	Attempts int `gorm:"not null;default:0"` // wrong two-factor codes entered against a login challenge, or 1 for a recorded miss
+}
+
+// RecoveryCode is a single-use backup for a user's authenticator app, shown
+// once when generated. Only its hash is stored.
+type RecoveryCode struct {
+	ID        string     `gorm:"primaryKey"`
+	UserID    string     `gorm:"not null;index"`
+	CodeHash  string     `gorm:"not null"` // SHA-256 of the normalized code
+	UsedAt    *time.Time // set once used to sign in
 	CreatedAt time.Time
 }
 
 // Product represents a product in the store
 type Product struct {
-	ID          string `gorm:"primaryKey"`
-	Name        string `gorm:"not null"`
-	Description string
-	Price       int64 `gorm:"not null"` // in cents
-	ImageURL    string
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
+	ID          string     `gorm:"primaryKey" json:"id"`
+	Name        string     `gorm:"not null" json:"name"`
+	Description string     `json:"description"`
+	Price       int64      `gorm:"not null" json:"price_cents"` // in cents
+	ImageURL    string     `json:"image_url"`
+	Stock       int        `gorm:"not null;default:0" json:"stock"`               // units on hand
+	WeightGrams int        `gorm:"not null;default:0" json:"weight_grams"`        // shipping weight of one unit
+	TaxCategory string     `gorm:"not null;default:standard" json:"tax_category"` // selects which tax rates apply
+	ArchivedAt  *time.Time `gorm:"index" json:"archived_at,omitempty"`            // hidden from the storefront when set
+	CategoryID  *string    `gorm:"index" json:"category_id,omitempty"`
+	Category    *Category  `gorm:"foreignKey:CategoryID" json:"category,omitempty"`
+	Tags        []Tag      `gorm:"many2many:product_tags" json:"tags,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+
+	// Variants, when a product has any, are what is sold; their stock
+	// replaces the product's own
+	Variants []ProductVariant `gorm:"foreignKey:ProductID" json:"variants,omitempty"`
+}
+
+// HasVariants reports whether the product is sold through variants. The
+// variants must have been loaded.
+func (p Product) HasVariants() bool {
+	return len(p.Variants) > 0
 }
 
-// CartItem represents an item in a user's cart
+// InStock reports whether any units are on hand, of any variant
+func (p Product) InStock() bool {
+	if p.HasVariants() {
+		for _, v := range p.Variants {
+			if v.Stock > 0 {
+				return true
+			}
+		}
+		return false
+	}
+	return p.Stock > 0
+}
+
+// TotalStock returns the units on hand, summed over variants when it has them
+func (p Product) TotalStock() int {
+	if !p.HasVariants() {
+		return p.Stock
+	}
+	total := 0
+	for _, v := range p.Variants {
+		total += v.Stock
+	}
+	return total
+}
+
+// ProductVariant is one version of a product, such as a size and color,
+// with its own SKU and stock and optionally its own price
+type ProductVariant struct {
+	ID         string            `gorm:"primaryKey" json:"id"`
+	ProductID  string            `gorm:"not null;index" json:"product_id"`
+	SKU        string            `gorm:"uniqueIndex;not null" json:"sku"`
+	Options    map[string]string `gorm:"type:jsonb;serializer:json" json:"options"` // e.g. {"color": "Black", "size": "M"}
+	Price      *int64            `json:"price_cents,omitempty"`                     // overrides the product price when set
+	Stock      int               `gorm:"not null;default:0" json:"stock"`
+	SortOrder  int               `gorm:"not null;default:0" json:"sort_order"`
+	ArchivedAt *time.Time        `gorm:"index" json:"archived_at,omitempty"` // no longer sold when set
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+}
+
+// Name describes the variant by its option values, e.g. "Black / M"
+func (v ProductVariant) Name() string {
+	keys := make([]string, 0, len(v.Options))
+	for key := range v.Options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = v.Options[key]
+	}
+	return strings.Join(values, " / ")
+}
+
+// PriceFor returns what one unit of the variant costs
+func (v ProductVariant) PriceFor(p Product) int64 {
+	if v.Price != nil {
+		return *v.Price
+	}
+	return p.Price
+}
+
+// Category groups products; categories nest via ParentID
+type Category struct {
+	ID        string     `gorm:"primaryKey" json:"id"`
+	Name      string     `gorm:"not null" json:"name"`
+	Slug      string     `gorm:"uniqueIndex;not null" json:"slug"`
+	ParentID  *string    `gorm:"index" json:"parent_id,omitempty"`
+	Children  []Category `gorm:"foreignKey:ParentID" json:"children,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// Tag is a free-form product label used for filtering
+type Tag struct {
+	ID   uint   `gorm:"primaryKey" json:"id"`
+	Name string `gorm:"not null" json:"name"`
+	Slug string `gorm:"uniqueIndex;not null" json:"slug"`
+}
+
+// CartItem represents an item in a user's or guest's cart
 type CartItem struct {
 	ID        uint    `gorm:"primaryKey"`
-	UserID    string  `gorm:"not null;index"`
+	UserID    string  `gorm:"index"` // empty for guest carts
+	GuestID   string  `gorm:"index"` // set for anonymous carts (see cart.go)
 	ProductID string  `gorm:"not null"`
 	Quantity  int     `gorm:"not null"`
 	Product   Product `gorm:"foreignKey:ProductID"`
 	CreatedAt time.Time
 	UpdatedAt time.Time
+
+	VariantID *string         `gorm:"index"` // set for products sold through variants
+	Variant   *ProductVariant `gorm:"foreignKey:VariantID"`
 }
 
-// Order represents a completed order
-type Order struct {
-	ID        string `gorm:"primaryKey"`
-	UserID    string `gorm:"not null;index"`
-	Total     int64  `gorm:"not null"`
-	Status    string `gorm:"not null"`
-	PaymentID string
+// UnitPrice returns the current price of one unit of the line
+func (i CartItem) UnitPrice() int64 {
+	if i.Variant != nil {
+		return i.Variant.PriceFor(i.Product)
+	}
+	return i.Product.Price
+}
+
+// DisplayName names the line's product and variant, e.g. "T-Shirt (Black / M)"
+func (i CartItem) DisplayName() string {
+	if i.Variant != nil {
+		return i.Product.Name + " (" + i.Variant.Name() + ")"
+	}
+	return i.Product.Name
+}
+
+// PostalAddress is a shipping destination. Address embeds it for the address
+// book and Order embeds a copy, so editing a saved address never changes
+// where a past order went.
+type PostalAddress struct {
+	FullName   string `json:"full_name"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	Region     string `json:"region,omitempty"` // state, province or county
+	PostalCode string `json:"postal_code,omitempty"`
+	Country    string `json:"country"` // ISO 3166-1 alpha-2 code
+	Phone      string `json:"phone,omitempty"`
+}
+
+// Address is an entry in a user's address book
+type Address struct {
+	ID            string `gorm:"primaryKey" json:"id"`
+	UserID        string `gorm:"not null;index;uniqueIndex:idx_addresses_one_default,where:is_default" json:"user_id"`
+	PostalAddress `gorm:"embedded"`
+	IsDefault     bool      `gorm:"not null;default:false" json:"is_default"` // at most one per user
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// Shipping method kinds, which decide how a method prices a cart
+const (
+	ShippingFlat     = "flat"      // BaseRate on every order
+	ShippingByWeight = "weight"    // BaseRate plus PerKgRate for each started kilogram
+	ShippingFreeOver = "free_over" // BaseRate, or nothing once the subtotal reaches FreeOver
+)
+
+// ShippingMethod is a delivery option offered at checkout
+type ShippingMethod struct {
+	ID             string    `gorm:"primaryKey" json:"id"`
+	Name           string    `gorm:"not null" json:"name"`
+	Description    string    `json:"description"`
+	Kind           string    `gorm:"not null" json:"kind"`
+	BaseRate       int64     `gorm:"not null;default:0" json:"base_rate_cents"`
+	PerKgRate      int64     `gorm:"not null;default:0" json:"per_kg_cents"`
+	FreeOver       int64     `gorm:"not null;default:0" json:"free_over_cents"`
+	MaxWeightGrams int       `gorm:"not null;default:0" json:"max_weight_grams"` // 0 for no limit
+	SortOrder      int       `gorm:"not null;default:0" json:"sort_order"`
+	Active         bool      `gorm:"not null" json:"active"` // only active methods are offered
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// Tax categories a product can belong to. Exempt products match no rates.
+const (
+	TaxStandard = "standard"
+	TaxReduced  = "reduced"
+	TaxExempt   = "exempt"
+)
+
+// TaxRate is one sales tax charged on a tax category in a country, or in
+// one region of it. A country-wide rate (Region "") applies alongside any
+// regional rate, e.g. Canada's GST plus a provincial sales tax.
+type TaxRate struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Name      string    `gorm:"not null" json:"name"`
+	Country   string    `gorm:"not null;index:idx_tax_rates_location" json:"country"` // ISO 3166-1 alpha-2 code
+	Region    string    `gorm:"not null;default:'';index:idx_tax_rates_location" json:"region"`
+	Category  string    `gorm:"not null;default:standard" json:"category"`
+	Rate      int       `gorm:"not null" json:"rate"` // thousandths of a percent (7250 = 7.25%)
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Coupon kinds, which decide what a coupon takes off
+const (
+	CouponPercent      = "percent"       // Value percent off eligible items
+	CouponFixed        = "fixed"         // Value cents off eligible items
+	CouponFreeShipping = "free_shipping" // waives the shipping charge
+)
+
+// Coupon is a discount code entered in the cart. A coupon scoped to
+// products or categories only discounts those items (and a category covers
+// its subcategories); an unscoped coupon discounts the whole cart.
+type Coupon struct {
+	ID             string     `gorm:"primaryKey" json:"id"`
+	Code           string     `gorm:"uniqueIndex;not null" json:"code"` // stored upper case
+	Description    string     `json:"description"`
+	Kind           string     `gorm:"not null" json:"kind"`
+	Value          int64      `gorm:"not null;default:0" json:"value"` // percent, or cents for fixed coupons
+	MinSubtotal    int64      `gorm:"not null;default:0" json:"min_subtotal_cents"`
+	StartsAt       *time.Time `json:"starts_at,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	MaxUses        int        `gorm:"not null;default:0" json:"max_uses"`          // 0 for no limit
+	MaxUsesPerUser int        `gorm:"not null;default:0" json:"max_uses_per_user"` // 0 for no limit
+	Active         bool       `gorm:"not null" json:"active"`
+	Products       []Product  `gorm:"many2many:coupon_products" json:"products,omitempty"`
+	Categories     []Category `gorm:"many2many:coupon_categories" json:"categories,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// CouponRedemption records a coupon used on an order. Redemptions on
+// cancelled orders no longer count towards the coupon's limits.
+type CouponRedemption struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CouponID  string    `gorm:"not null;index" json:"coupon_id"`
+	UserID    string    `gorm:"not null;index" json:"user_id"`
+	OrderID   string    `gorm:"not null;uniqueIndex" json:"order_id"`
+	Amount    int64     `gorm:"not null" json:"amount_cents"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// StockReservation holds units for a user while they complete checkout
+type StockReservation struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    string    `gorm:"not null;index"`
+	ProductID string    `gorm:"not null;index"`
+	Quantity  int       `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null;index"`
 	CreatedAt time.Time
-	UpdatedAt time.Time
-	Items     []OrderItem `gorm:"foreignKey:OrderID"`
+
+	VariantID *string `gorm:"index"` // holds a variant's stock rather than the product's
+}
+
+// Order represents a placed order. Status follows the lifecycle in
+// orderstatus.go and only changes through transitionOrder.
+type Order struct {
+	ID             string      `gorm:"primaryKey" json:"id"`
+	UserID         string      `gorm:"not null;index" json:"user_id"`
+	Total          int64       `gorm:"not null" json:"total_cents"`
+	Status         string      `gorm:"not null" json:"status"`
+	PaymentID      string      `gorm:"index" json:"payment_id"`
+	PaymentStatus  string      `json:"payment_status"`                           // processor's status, kept in sync by webhooks
+	RefundedAmount int64       `gorm:"not null;default:0" json:"refunded_cents"` // sum of refunds not rejected or failed
+	CreatedAt      time.Time   `json:"created_at"`
+	UpdatedAt      time.Time   `json:"updated_at"`
+	User           *User       `gorm:"foreignKey:UserID" json:"-"`
+	Items          []OrderItem `gorm:"foreignKey:OrderID" json:"items,omitempty"`
+	Refunds        []Refund    `gorm:"foreignKey:OrderID" json:"refunds,omitempty"`
+
+	StatusHistory []OrderStatusChange `gorm:"foreignKey:OrderID" json:"status_history,omitempty"`
+
+	// ShippingAddress is a snapshot of where the order ships, taken at checkout
+	ShippingAddress PostalAddress `gorm:"embedded;embeddedPrefix:ship_" json:"shipping_address"`
+
+	// Shipping chosen at checkout; Total includes ShippingCost
+	ShippingMethodID string `json:"shipping_method_id,omitempty"`
+	ShippingMethod   string `json:"shipping_method,omitempty"` // method name at time of purchase
+	ShippingCost     int64  `gorm:"not null;default:0" json:"shipping_cents"`
+
+	// TaxAmount is the sales tax charged, also included in Total
+	TaxAmount int64 `gorm:"not null;default:0" json:"tax_cents"`
+
+	// Coupon redeemed at checkout. DiscountAmount covers item discounts and
+	// any waived shipping, and has already been taken off Total.
+	CouponCode     string `json:"coupon_code,omitempty"`
+	DiscountAmount int64  `gorm:"not null;default:0" json:"discount_cents"`
+
+	// FulfillmentStatus is the furthest fulfillment status the order has
+	// reached. Refund statuses replace Status but not this, so a partially
+	// refunded order still knows where it is in fulfillment.
+	FulfillmentStatus string `gorm:"not null;default:''" json:"fulfillment_status,omitempty"`
+}
+
+// Subtotal returns the order total before discounts, shipping and tax
+func (o Order) Subtotal() int64 {
+	return o.Total - o.ShippingCost - o.TaxAmount + o.DiscountAmount
+}
+
+// RefundableAmount returns how much of the order total can still be refunded
+func (o Order) RefundableAmount() int64 {
+	return o.Total - o.RefundedAmount
+}
+
+// ItemCount returns the total number of units in the order
+func (o Order) ItemCount() int {
+	count := 0
+	for _, item := range o.Items {
+		count += item.Quantity
+	}
+	return count
 }
 
 // OrderItem represents a product in an order
 type OrderItem struct {
-	ID        uint    `gorm:"primaryKey"`
-	OrderID   string  `gorm:"not null;index"`
-	ProductID string  `gorm:"not null"`
-	Quantity  int     `gorm:"not null"`
-	Price     int64   `gorm:"not null"` // Price at time of purchase
-	Product   Product `gorm:"foreignKey:ProductID"`
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	OrderID   string    `gorm:"not null;index" json:"order_id"`
+	ProductID string    `gorm:"not null" json:"product_id"`
+	Quantity  int       `gorm:"not null" json:"quantity"`
+	Price     int64     `gorm:"not null" json:"price_cents"` // Price at time of purchase
+	Product   Product   `gorm:"foreignKey:ProductID" json:"product"`
+	CreatedAt time.Time `json:"created_at"`
+
+	RefundedQuantity int   `gorm:"not null;default:0" json:"refunded_quantity"`
+	TaxAmount        int64 `gorm:"not null;default:0" json:"tax_cents"`      // tax charged on the whole line
+	DiscountAmount   int64 `gorm:"not null;default:0" json:"discount_cents"` // coupon discount on the whole line
+
+	// Variant bought, with its SKU and name at time of purchase
+	VariantID   *string `gorm:"index" json:"variant_id,omitempty"`
+	SKU         string  `json:"sku,omitempty"`
+	VariantName string  `json:"variant_name,omitempty"`
+}
+
+// DisplayName names the line's product and variant as purchased
+func (i OrderItem) DisplayName() string {
+	if i.VariantName != "" {
+		return i.Product.Name + " (" + i.VariantName + ")"
+	}
+	return i.Product.Name
+}
+
+// RefundableQuantity returns how many units of the line can still be refunded
+func (i OrderItem) RefundableQuantity() int {
+	return i.Quantity - i.RefundedQuantity
+}
+
+// OrderStatusChange records one step of an order's lifecycle
+type OrderStatusChange struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	OrderID    string    `gorm:"not null;index" json:"order_id"`
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `gorm:"not null" json:"to_status"`
+	ActorID    string    `json:"actor_id,omitempty"`    // empty for system changes
+	Actor      string    `gorm:"not null" json:"actor"` // user email, or "system"
+	Note       string    `json:"note,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Refund records money returned on an order's payment. Refunds issued from
+// the admin console list the order lines they cover; refunds made directly
+// with the processor arrive through webhooks without items.
+type Refund struct {
+	ID               string       `gorm:"primaryKey" json:"id"`
+	OrderID          string       `gorm:"not null;index" json:"order_id"`
+	ProviderRefundID *string      `gorm:"uniqueIndex" json:"provider_refund_id"` // set once the processor accepts the refund
+	Amount           int64        `gorm:"not null" json:"amount_cents"`
+	Status           string       `gorm:"not null" json:"status"`
+	Reason           string       `json:"reason,omitempty"`
+	IssuedBy         string       `json:"issued_by,omitempty"` // staff user ID
+	Restocked        bool         `gorm:"not null;default:false" json:"restocked"`
+	Items            []RefundItem `gorm:"foreignKey:RefundID" json:"items,omitempty"`
+	CreatedAt        time.Time    `json:"created_at"`
+	UpdatedAt        time.Time    `json:"updated_at"`
+}
+
+// RefundItem is the part of one order line covered by a refund
+type RefundItem struct {
+	ID          uint   `gorm:"primaryKey" json:"id"`
+	RefundID    string `gorm:"not null;index" json:"refund_id"`
+	OrderItemID uint   `gorm:"not null;index" json:"order_item_id"`
+	Quantity    int    `gorm:"not null" json:"quantity"`
+	Amount      int64  `gorm:"not null" json:"amount_cents"`
+}
+
+// WebhookEvent is a payment processor notification, stored by the
+// processor's event ID so redeliveries are only applied once
+type WebhookEvent struct {
+	ID        string `gorm:"primaryKey"`
+	Provider  string `gorm:"not null"`
+	Type      string `gorm:"not null"`
+	Payload   string `gorm:"type:text;not null"`
 	CreatedAt time.Time
 }
 
 // TableName overrides for GORM
-func (User) TableName() string      { return "users" }
-func (Session) TableName() string   { return "sessions" }
-func (Product) TableName() string   { return "products" }
-func (CartItem) TableName() string  { return "cart_items" }
-func (Order) TableName() string     { return "orders" }
-func (OrderItem) TableName() string { return "order_items" }
+func (User) TableName() string              { return "users" }
+func (Session) TableName() string           { return "sessions" }
+func (Product) TableName() string           { return "products" }
+func (ProductVariant) TableName() string    { return "product_variants" }
+func (Category) TableName() string          { return "categories" }
+func (Tag) TableName() string               { return "tags" }
+func (Address) TableName() string           { return "addresses" }
+func (ShippingMethod) TableName() string    { return "shipping_methods" }
+func (TaxRate) TableName() string           { return "tax_rates" }
+func (Coupon) TableName() string            { return "coupons" }
+func (CouponRedemption) TableName() string  { return "coupon_redemptions" }
+func (CartItem) TableName() string          { return "cart_items" }
+func (StockReservation) TableName() string  { return "stock_reservations" }
+func (Order) TableName() string             { return "orders" }
+func (OrderItem) TableName() string         { return "order_items" }
+func (OrderStatusChange) TableName() string { return "order_status_history" }
+func (Refund) TableName() string            { return "refunds" }
+func (RefundItem) TableName() string        { return "refund_items" }
+func (WebhookEvent) TableName() string      { return "webhook_events" }
+func (AccountToken) TableName() string      { return "account_tokens" }
+func (RecoveryCode) TableName() string      { return "recovery_codes" }
 
 // BeforeCreate hooks for UUID generation
 func (u *User) BeforeCreate(tx *gorm.DB) error {
@@ -100,6 +522,41 @@ func (p *Product) BeforeCreate(tx *gorm.DB) error {
 	return nil
 }
 
+func (v *ProductVariant) BeforeCreate(tx *gorm.DB) error {
+	if v.ID == "" {
+		v.ID = generateUUID()
+	}
+	return nil
+}
+
+func (c *Category) BeforeCreate(tx *gorm.DB) error {
+	if c.ID == "" {
+		c.ID = generateUUID()
+	}
+	return nil
+}
+
+func (m *ShippingMethod) BeforeCreate(tx *gorm.DB) error {
+	if m.ID == "" {
+		m.ID = generateUUID()
+	}
+	return nil
+}
+
+func (c *Coupon) BeforeCreate(tx *gorm.DB) error {
+	if c.ID == "" {
+		c.ID = generateUUID()
+	}
+	return nil
+}
+
+func (a *Address) BeforeCreate(tx *gorm.DB) error {
+	if a.ID == "" {
+		a.ID = generateUUID()
+	}
+	return nil
+}
+
 func (o *Order) BeforeCreate(tx *gorm.DB) error {
 	if o.ID == "" {
 		o.ID = generateUUID()
@@ -107,6 +564,13 @@ func (o *Order) BeforeCreate(tx *gorm.DB) error {
 	return nil
 }
 
+func (r *Refund) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == "" {
+		r.ID = generateUUID()
+	}
+	return nil
+}
+
 func generateUUID() string {
 	return time.Now().Format("20060102150405") + "-" + randomString(8)
 }
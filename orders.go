@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Outcomes of a failed placeOrder for a payment that had been captured
+var (
+	// ErrPaymentRefunded means the captured payment was refunded in full
+	ErrPaymentRefunded = errors.New("payment refunded")
+
+	// ErrPaymentNotRefunded means the refund failed and staff must issue it
+	ErrPaymentNotRefunded = errors.New("payment captured but not refunded")
+)
+
+// ErrCartChanged is returned when the priced cart lines are no longer in
+// the cart, e.g. because the same cart was already submitted
+var ErrCartChanged = errors.New("cart changed during checkout")
+
+// placeOrder converts the user's priced cart into an Order shipping to
+// shipTo and captures the authorized payment. The cart lines are taken
+// out of the cart, and the order, its item snapshots, the stock and the
+// coupon redemption recorded, in one transaction committed before the
+// capture, so their row locks aren't held during the call to the payment
+// provider. If the order can't be recorded the authorization is voided;
+// if the capture fails the order is released and the authorization voided;
+// if the order can't be completed after the capture the payment is refunded
+// and the error wraps ErrPaymentRefunded (or ErrPaymentNotRefunded).
+func placeOrder(user *User, priced PricedCart, shipTo PostalAddress, auth *PaymentResult) (*Order, error) {
+	order := &Order{
+		ID:               uuid.New().String(),
+		UserID:           user.ID,
+		Total:            priced.Total,
+		Status:           OrderStatusPending,
+		PaymentID:        auth.PaymentID,
+		PaymentStatus:    auth.Status,
+		ShippingAddress:  shipTo,
+		ShippingMethodID: priced.Shipping.MethodID,
+		ShippingMethod:   priced.Shipping.Name,
+		ShippingCost:     priced.Shipping.Cost,
+		TaxAmount:        priced.Tax.Total,
+		CouponCode:       priced.Discount.Code,
+		DiscountAmount:   priced.Discount.Total(),
+		CreatedAt:        time.Now(),
+	}
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		// Take the lines out of the cart first. The delete locks them, so a
+		// second submit of the same cart waits here and then finds them
+		// gone rather than ordering them again.
+		lineIDs := make([]uint, len(priced.Lines))
+		for i, line := range priced.Lines {
+			lineIDs[i] = line.ID
+		}
+		result := tx.Where("user_id = ? AND id IN ?", user.ID, lineIDs).Delete(&CartItem{})
+		if result.Error != nil {
+			return fmt.Errorf("clear cart: %w", result.Error)
+		}
+		if result.RowsAffected != int64(len(lineIDs)) {
+			return ErrCartChanged
+		}
+
+		if err := tx.Create(order).Error; err != nil {
+			return fmt.Errorf("create order: %w", err)
+		}
+
+		// Snapshot each cart line with the price, discount and tax at time of purchase
+		for _, line := range priced.Lines {
+			orderItem := OrderItem{
+				OrderID:        order.ID,
+				ProductID:      line.ProductID,
+				Quantity:       line.Quantity,
+				Price:          line.UnitPrice(),
+				TaxAmount:      line.Tax,
+				DiscountAmount: line.Discount,
+			}
+			if line.Variant != nil {
+				orderItem.VariantID = line.VariantID
+				orderItem.SKU = line.Variant.SKU
+				orderItem.VariantName = line.Variant.Name()
+			}
+			if err := tx.Create(&orderItem).Error; err != nil {
+				return fmt.Errorf("create order item: %w", err)
+			}
+			order.Items = append(order.Items, orderItem)
+		}
+
+		if priced.Discount.CouponID != "" {
+			if err := redeemCoupon(tx, priced.Discount, user.ID, order.ID); err != nil {
+				return fmt.Errorf("redeem coupon: %w", err)
+			}
+		}
+
+		// Take the purchased units out of stock and release checkout holds
+		if err := decrementStock(tx, user.ID, priced.Items()); err != nil {
+			return fmt.Errorf("decrement stock: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		voidPayment(auth)
+		return nil, err
+	}
+
+	payment, err := Payments.Capture(auth.PaymentID)
+	if err != nil {
+		voidPayment(auth)
+		order.PaymentStatus = PaymentStatusCanceled
+		if releaseErr := releaseOrder(order, "Payment capture failed"); releaseErr != nil {
+			log.Printf("CRITICAL: failed to release order %s: %v", order.ID, releaseErr)
+		}
+		restoreCart(user.ID, priced.Items())
+		return nil, fmt.Errorf("capture payment: %w", err)
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		order.PaymentStatus = payment.Status
+		if err := tx.Model(order).Update("payment_status", payment.Status).Error; err != nil {
+			return fmt.Errorf("update payment status: %w", err)
+		}
+		return transitionOrder(tx, order, OrderStatusPaid, nil, "Payment captured")
+	})
+	if err != nil {
+		if _, refundErr := Payments.Refund(auth.PaymentID, auth.Amount, uuid.New().String(), "Order could not be recorded"); refundErr != nil {
+			log.Printf("CRITICAL: failed to refund payment %s: %v", auth.PaymentID, refundErr)
+			return nil, fmt.Errorf("%w: %w", ErrPaymentNotRefunded, err)
+		}
+		order.RefundedAmount = auth.Amount
+		if releaseErr := releaseOrder(order, "Order could not be completed; payment refunded"); releaseErr != nil {
+			log.Printf("CRITICAL: failed to release order %s: %v", order.ID, releaseErr)
+		}
+		restoreCart(user.ID, priced.Items())
+		return nil, fmt.Errorf("%w: %w", ErrPaymentRefunded, err)
+	}
+
+	return order, nil
+}
+
+// restoreCart puts the lines of an order that fell through back in the
+// user's cart, so they can try again
+func restoreCart(userID string, items []CartItem) {
+	for _, item := range items {
+		line := CartItem{
+			UserID:    userID,
+			ProductID: item.ProductID,
+			VariantID: item.VariantID,
+			Quantity:  item.Quantity,
+		}
+		if err := DB.Create(&line).Error; err != nil {
+			log.Printf("Failed to restore cart of user %s: %v", userID, err)
+		}
+	}
+}
+
+// voidPayment releases an authorization that will not be captured
+func voidPayment(auth *PaymentResult) {
+	if _, err := Payments.Void(auth.PaymentID); err != nil {
+		log.Printf("CRITICAL: failed to void payment %s: %v", auth.PaymentID, err)
+	}
+}
+
+// releaseOrder cancels a recorded order whose payment did not go through:
+// its units go back in stock and its coupon redemption is released. The
+// order's payment status and refunded amount are saved as they are.
+func releaseOrder(order *Order, note string) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		current, err := lockOrder(tx, "id = ?", order.ID)
+		if err != nil {
+			return err
+		}
+		order.Status = current.Status
+		order.Items = current.Items
+		if order.Status == OrderStatusCancelled || order.Status == OrderStatusRefunded {
+			// Already released; restocking again would add phantom units
+			return nil
+		}
+
+		if err := restockOrder(tx, order); err != nil {
+			return err
+		}
+		if err := tx.Where("order_id = ?", order.ID).Delete(&CouponRedemption{}).Error; err != nil {
+			return fmt.Errorf("release coupon: %w", err)
+		}
+		err = tx.Model(order).Updates(map[string]interface{}{
+			"payment_status":  order.PaymentStatus,
+			"refunded_amount": order.RefundedAmount,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return transitionOrder(tx, order, OrderStatusCancelled, nil, note)
+	})
+}
+
+// Order history pagination
+const (
+	ordersPerPage    = 10
+	maxOrdersPerPage = 50
+)
+
+// listUserOrders returns one page of the user's orders, newest first, along
+// with the total number of orders they have placed
+func listUserOrders(userID string, page, perPage int) ([]Order, int64, error) {
+	var total int64
+	if err := DB.Model(&Order{}).Where("user_id = ?", userID).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var orders []Order
+	err := DB.Preload("Items.Product").
+		Where("user_id = ?", userID).
+		Order("created_at DESC, id DESC").
+		Limit(perPage).
+		Offset((page - 1) * perPage).
+		Find(&orders).Error
+	return orders, total, err
+}
+
+// pageParams reads page and per_page query parameters with sane bounds
+func pageParams(r *http.Request, defaultPerPage, maxPerPage int) (page, perPage int) {
+	page, _ = strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ = strconv.Atoi(r.URL.Query().Get("per_page"))
+	if perPage < 1 {
+		perPage = defaultPerPage
+	}
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+	return page, perPage
+}
+
+// ordersHandler shows the current user's order history
+func ordersHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := getCurrentUser(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	tmpl := template.New("orders.html").Funcs(template.FuncMap{
+		"divf": func(a, b int64) float64 {
+			return float64(a) / float64(b)
+		},
+	})
+
+	tmpl, err = tmpl.ParseFiles("templates/orders.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Template error: %v", err)
+		return
+	}
+
+	page, _ := pageParams(r, ordersPerPage, ordersPerPage)
+	orders, total, err := listUserOrders(user.ID, page, ordersPerPage)
+	if err != nil {
+		log.Printf("Failed to load orders: %v", err)
+		http.Error(w, "Failed to load orders", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Orders":   orders,
+		"Page":     page,
+		"PrevPage": page - 1,
+		"NextPage": page + 1,
+		"HasPrev":  page > 1,
+		"HasNext":  int64(page*ordersPerPage) < total,
+		"Total":    total,
+		"User":     user,
+	}
+
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("Template execution error: %v", err)
+	}
+}
+
+// orderDetailHandler shows a single past order
+func orderDetailHandler(w http.ResponseWriter, r *http.Request) {
+	renderOrderPage(w, r, false)
+}
+
+// renderOrderPage renders one of the user's orders with the confirmation
+// template. confirmation selects the post-checkout wording.
+func renderOrderPage(w http.ResponseWriter, r *http.Request, confirmation bool) {
+	user, err := getCurrentUser(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	orderID := r.URL.Query().Get("id")
+
+	// Get order from database
+	var order Order
+	result := DB.Preload("Items.Product").Where("id = ? AND user_id = ?", orderID, user.ID).First(&order)
+	if result.Error != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	tmpl := template.New("order-confirmation.html").Funcs(template.FuncMap{
+		"divf": func(a, b int64) float64 {
+			return float64(a) / float64(b)
+		},
+	})
+
+	tmpl, err = tmpl.ParseFiles("templates/order-confirmation.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"ID":             order.ID,
+		"Items":          order.Items,
+		"Subtotal":       order.Subtotal(),
+		"ShippingMethod": order.ShippingMethod,
+		"ShippingCost":   order.ShippingCost,
+		"TaxAmount":      order.TaxAmount,
+		"CouponCode":     order.CouponCode,
+		"DiscountAmount": order.DiscountAmount,
+		"Total":          order.Total,
+		"Status":         order.Status,
+		"CreatedAt":      order.CreatedAt,
+		"ShipTo":         order.ShippingAddress,
+		"Confirmation":   confirmation,
+		"CanCancel":      order.CustomerCanCancel(),
+		"CancelDeadline": order.CancelDeadline(),
+		"Notice":         r.URL.Query().Get("notice"),
+		"Error":          r.URL.Query().Get("error"),
+		"User":           user,
+	}
+
+	tmpl.Execute(w, data)
+}
+
+// orderSummary is the list-view JSON shape of an order
+type orderSummary struct {
+	ID        string    `json:"id"`
+	Status    string    `json:"status"`
+	Total     int64     `json:"total_cents"`
+	ItemCount int       `json:"item_count"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ordersAPIHandler returns the current user's order history as JSON
+func ordersAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, err := getCurrentUser(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+		return
+	}
+
+	page, perPage := pageParams(r, ordersPerPage, maxOrdersPerPage)
+	orders, total, err := listUserOrders(user.ID, page, perPage)
+	if err != nil {
+		log.Printf("Failed to load orders: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load orders"})
+		return
+	}
+
+	summaries := make([]orderSummary, 0, len(orders))
+	for _, order := range orders {
+		summaries = append(summaries, orderSummary{
+			ID:        order.ID,
+			Status:    order.Status,
+			Total:     order.Total,
+			ItemCount: order.ItemCount(),
+			CreatedAt: order.CreatedAt,
+		})
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"orders":      summaries,
+		"page":        page,
+		"per_page":    perPage,
+		"total_count": total,
+		"has_more":    int64(page*perPage) < total,
+	})
+}
+
+// orderDetailAPIHandler returns one of the current user's orders as JSON
+func orderDetailAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, err := getCurrentUser(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+		return
+	}
+
+	var order Order
+	result := DB.Preload("Items.Product").Where("id = ? AND user_id = ?", r.URL.Query().Get("id"), user.ID).First(&order)
+	if result.Error != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Order not found"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"order":      order,
+		"item_count": order.ItemCount(),
+		"can_cancel": order.CustomerCanCancel(),
+	})
+}
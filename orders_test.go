@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// checkoutFixture is a customer with a product in their cart, priced and
+// authorized through the provider PAYMENT_PROVIDER selects
+type checkoutFixture struct {
+	user    *User
+	product *Product
+	priced  PricedCart
+	auth    *PaymentResult
+	fake    *fakeProvider
+}
+
+func newCheckoutFixture(t *testing.T) *checkoutFixture {
+	t.Helper()
+	useTestDatabase(t)
+
+	t.Setenv("PAYMENT_PROVIDER", "fake")
+	previous := Payments
+	InitPayments()
+	t.Cleanup(func() { Payments = previous })
+
+	fake, ok := Payments.(*fakeProvider)
+	if !ok {
+		t.Fatalf("PAYMENT_PROVIDER=fake selected the %s provider", Payments.Name())
+	}
+
+	user := createTestUser(t)
+	product := createTestProduct(t, Product{Name: "Mechanical Keyboard", Price: 4999, Stock: 5})
+	item := CartItem{UserID: user.ID, ProductID: product.ID, Quantity: 2}
+	if err := DB.Create(&item).Error; err != nil {
+		t.Fatalf("add to cart: %v", err)
+	}
+
+	priced, err := priceCart(loadCart(cartOwner{UserID: user.ID}), pricingOptions{UserID: user.ID})
+	if err != nil {
+		t.Fatalf("priceCart: %v", err)
+	}
+
+	auth, err := Payments.Authorize(PaymentRequest{
+		SourceID:       FakeSourceOK,
+		IdempotencyKey: uuid.New().String(),
+		Amount:         priced.Total,
+		Currency:       "USD",
+		BuyerEmail:     user.Email,
+	})
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	if auth.Status != PaymentStatusApproved {
+		t.Fatalf("authorization status = %s, want %s", auth.Status, PaymentStatusApproved)
+	}
+
+	return &checkoutFixture{user: user, product: product, priced: priced, auth: auth, fake: fake}
+}
+
+// payment returns the fake provider's record of the authorized payment
+func (f *checkoutFixture) payment() *fakePayment {
+	return f.fake.payments[f.auth.PaymentID]
+}
+
+// stock returns the product's units on hand
+func (f *checkoutFixture) stock(t *testing.T) int {
+	t.Helper()
+
+	var product Product
+	if err := DB.First(&product, "id = ?", f.product.ID).Error; err != nil {
+		t.Fatalf("load product: %v", err)
+	}
+	return product.Stock
+}
+
+// orderForPayment loads the order recorded for the authorized payment
+func (f *checkoutFixture) orderForPayment(t *testing.T) Order {
+	t.Helper()
+
+	var order Order
+	if err := DB.Where("payment_id = ?", f.auth.PaymentID).First(&order).Error; err != nil {
+		t.Fatalf("load order: %v", err)
+	}
+	return order
+}
+
+func TestPlaceOrderCapturesPayment(t *testing.T) {
+	f := newCheckoutFixture(t)
+
+	order, err := placeOrder(f.user, f.priced, PostalAddress{Country: "US"}, f.auth)
+	if err != nil {
+		t.Fatalf("placeOrder: %v", err)
+	}
+
+	if got := f.payment().Status; got != PaymentStatusCompleted {
+		t.Errorf("payment status = %s, want %s", got, PaymentStatusCompleted)
+	}
+	if f.payment().refunded != 0 {
+		t.Errorf("payment refunded %d, want nothing", f.payment().refunded)
+	}
+
+	saved := f.orderForPayment(t)
+	if saved.ID != order.ID {
+		t.Errorf("order for payment = %s, want %s", saved.ID, order.ID)
+	}
+	if saved.Status != OrderStatusPaid || saved.PaymentStatus != PaymentStatusCompleted {
+		t.Errorf("order is %s with payment %s, want %s with %s",
+			saved.Status, saved.PaymentStatus, OrderStatusPaid, PaymentStatusCompleted)
+	}
+	if saved.Total != f.priced.Total {
+		t.Errorf("order total = %d, want %d", saved.Total, f.priced.Total)
+	}
+	if got := f.stock(t); got != 3 {
+		t.Errorf("stock = %d, want 3", got)
+	}
+	if got := countCart(cartOwner{UserID: f.user.ID}); got != 0 {
+		t.Errorf("cart has %d lines after checkout, want 0", got)
+	}
+}
+
+func TestPlaceOrderRefundsWhenFailingAfterCapture(t *testing.T) {
+	f := newCheckoutFixture(t)
+
+	// Saving the captured payment status is the first update of the order
+	failed := false
+	err := DB.Callback().Update().Before("gorm:update").Register("test:fail_order_update", func(db *gorm.DB) {
+		if db.Statement.Table == "orders" && !failed {
+			failed = true
+			db.AddError(errors.New("database unavailable"))
+		}
+	})
+	if err != nil {
+		t.Fatalf("register callback: %v", err)
+	}
+
+	_, err = placeOrder(f.user, f.priced, PostalAddress{Country: "US"}, f.auth)
+	if !errors.Is(err, ErrPaymentRefunded) {
+		t.Fatalf("placeOrder error = %v, want ErrPaymentRefunded", err)
+	}
+
+	if got := f.payment().Status; got != PaymentStatusCompleted {
+		t.Errorf("payment status = %s, want %s", got, PaymentStatusCompleted)
+	}
+	if got := f.payment().refunded; got != f.auth.Amount {
+		t.Errorf("payment refunded %d, want %d", got, f.auth.Amount)
+	}
+
+	saved := f.orderForPayment(t)
+	if saved.Status != OrderStatusCancelled {
+		t.Errorf("order status = %s, want %s", saved.Status, OrderStatusCancelled)
+	}
+	if saved.RefundedAmount != f.auth.Amount {
+		t.Errorf("order refunded amount = %d, want %d", saved.RefundedAmount, f.auth.Amount)
+	}
+	if got := f.stock(t); got != 5 {
+		t.Errorf("stock = %d, want 5 after the order was released", got)
+	}
+	if got := countCart(cartOwner{UserID: f.user.ID}); got != 1 {
+		t.Errorf("cart has %d lines, want the line put back", got)
+	}
+}
+
+func TestPlaceOrderRejectsSecondSubmitOfCart(t *testing.T) {
+	f := newCheckoutFixture(t)
+
+	if _, err := placeOrder(f.user, f.priced, PostalAddress{Country: "US"}, f.auth); err != nil {
+		t.Fatalf("first placeOrder: %v", err)
+	}
+
+	second, err := Payments.Authorize(PaymentRequest{
+		SourceID:       FakeSourceOK,
+		IdempotencyKey: uuid.New().String(),
+		Amount:         f.priced.Total,
+		Currency:       "USD",
+	})
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	_, err = placeOrder(f.user, f.priced, PostalAddress{Country: "US"}, second)
+	if !errors.Is(err, ErrCartChanged) {
+		t.Fatalf("second placeOrder error = %v, want ErrCartChanged", err)
+	}
+
+	if got := f.fake.payments[second.PaymentID].Status; got != PaymentStatusCanceled {
+		t.Errorf("second payment status = %s, want %s", got, PaymentStatusCanceled)
+	}
+	var count int64
+	if err := DB.Model(&Order{}).Where("user_id = ?", f.user.ID).Count(&count).Error; err != nil {
+		t.Fatalf("count orders: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("%d orders recorded, want 1", count)
+	}
+	if got := f.stock(t); got != 3 {
+		t.Errorf("stock = %d, want 3", got)
+	}
+}
+
+func TestPlaceOrderVoidsWhenFailingBeforeCapture(t *testing.T) {
+	f := newCheckoutFixture(t)
+
+	// The last units sell to someone else between authorizing and ordering
+	if err := DB.Model(&Product{}).Where("id = ?", f.product.ID).Update("stock", 1).Error; err != nil {
+		t.Fatalf("update stock: %v", err)
+	}
+
+	_, err := placeOrder(f.user, f.priced, PostalAddress{Country: "US"}, f.auth)
+	if !errors.Is(err, ErrInsufficientStock) {
+		t.Fatalf("placeOrder error = %v, want ErrInsufficientStock", err)
+	}
+
+	if got := f.payment().Status; got != PaymentStatusCanceled {
+		t.Errorf("payment status = %s, want %s", got, PaymentStatusCanceled)
+	}
+	if f.payment().refunded != 0 {
+		t.Errorf("payment refunded %d, want nothing", f.payment().refunded)
+	}
+
+	var count int64
+	if err := DB.Model(&Order{}).Where("payment_id = ?", f.auth.PaymentID).Count(&count).Error; err != nil {
+		t.Fatalf("count orders: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("%d orders recorded, want none", count)
+	}
+	if got := f.stock(t); got != 1 {
+		t.Errorf("stock = %d, want 1", got)
+	}
+	if got := countCart(cartOwner{UserID: f.user.ID}); got != 1 {
+		t.Errorf("cart has %d lines, want it kept", got)
+	}
+}
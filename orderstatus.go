@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Order statuses, in lifecycle order
+const (
+	OrderStatusPending           = "pending"
+	OrderStatusPaid              = "paid"
+	OrderStatusProcessing        = "processing"
+	OrderStatusShipped           = "shipped"
+	OrderStatusDelivered         = "delivered"
+	OrderStatusCancelled         = "cancelled"
+	OrderStatusPartiallyRefunded = "partially_refunded"
+	OrderStatusRefunded          = "refunded"
+)
+
+// orderStatuses lists every status for filters and validation
+var orderStatuses = []string{
+	OrderStatusPending,
+	OrderStatusPaid,
+	OrderStatusProcessing,
+	OrderStatusShipped,
+	OrderStatusDelivered,
+	OrderStatusCancelled,
+	OrderStatusPartiallyRefunded,
+	OrderStatusRefunded,
+}
+
+// fulfillmentSteps are the statuses an order moves through as it is
+// fulfilled, in order. Fulfillment never goes back a step.
+var fulfillmentSteps = []string{
+	OrderStatusPaid,
+	OrderStatusProcessing,
+	OrderStatusShipped,
+	OrderStatusDelivered,
+}
+
+// orderTransitions is the order lifecycle: the statuses each status may move
+// to. A partially refunded order may also take its next fulfillment step
+// (see Order.nextStatuses). Cancelled and refunded are final.
+var orderTransitions = map[string][]string{
+	OrderStatusPending:           {OrderStatusPaid, OrderStatusCancelled},
+	OrderStatusPaid:              {OrderStatusProcessing, OrderStatusCancelled, OrderStatusPartiallyRefunded, OrderStatusRefunded},
+	OrderStatusProcessing:        {OrderStatusShipped, OrderStatusCancelled, OrderStatusPartiallyRefunded, OrderStatusRefunded},
+	OrderStatusShipped:           {OrderStatusDelivered, OrderStatusPartiallyRefunded, OrderStatusRefunded},
+	OrderStatusDelivered:         {OrderStatusPartiallyRefunded, OrderStatusRefunded},
+	OrderStatusPartiallyRefunded: {OrderStatusRefunded},
+	OrderStatusCancelled:         {},
+	OrderStatusRefunded:          {},
+}
+
+// staffStatuses are the fulfillment statuses staff may set by hand. The
+// others follow from payments, refunds and cancellations.
+var staffStatuses = map[string]bool{
+	OrderStatusProcessing: true,
+	OrderStatusShipped:    true,
+	OrderStatusDelivered:  true,
+}
+
+// ErrIllegalTransition is returned for moves the lifecycle does not allow
+var ErrIllegalTransition = errors.New("illegal order status transition")
+
+// fulfillmentRank returns a status's position in fulfillmentSteps counting
+// from 1, or 0 when it is not a fulfillment status
+func fulfillmentRank(status string) int {
+	for i, step := range fulfillmentSteps {
+		if step == status {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// fulfillment returns the furthest fulfillment status the order has reached
+func (o Order) fulfillment() string {
+	if o.FulfillmentStatus != "" {
+		return o.FulfillmentStatus
+	}
+	if fulfillmentRank(o.Status) > 0 {
+		return o.Status
+	}
+	return ""
+}
+
+// nextStatuses returns the statuses the order may move to from where it is
+func (o Order) nextStatuses() []string {
+	next := orderTransitions[o.Status]
+	if o.Status != OrderStatusPartiallyRefunded {
+		return next
+	}
+
+	// A partial refund pauses fulfillment where it was; it continues with
+	// the following step, never an earlier one
+	if rank := fulfillmentRank(o.fulfillment()); rank > 0 && rank < len(fulfillmentSteps) {
+		next = append([]string{fulfillmentSteps[rank]}, next...)
+	}
+	return next
+}
+
+// canMoveTo reports whether the lifecycle allows the order to move to a
+// status. Fulfillment only ever moves forward.
+func (o Order) canMoveTo(to string) bool {
+	if rank := fulfillmentRank(to); rank > 0 && rank <= fulfillmentRank(o.fulfillment()) {
+		return false
+	}
+	for _, next := range o.nextStatuses() {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// NextStaffStatuses returns the statuses staff can move the order to
+func (o Order) NextStaffStatuses() []string {
+	var next []string
+	for _, status := range o.nextStatuses() {
+		if staffStatuses[status] {
+			next = append(next, status)
+		}
+	}
+	return next
+}
+
+// transitionOrder moves an order to a new status and records the change.
+// actor is the user making the change, or nil for changes made by the system
+// (payments, webhooks). Moving to the current status does nothing.
+func transitionOrder(tx *gorm.DB, order *Order, to string, actor *User, note string) error {
+	from := order.Status
+	if from == to {
+		return nil
+	}
+	if !order.canMoveTo(to) {
+		return fmt.Errorf("%w: %s to %s", ErrIllegalTransition, from, to)
+	}
+
+	updates := map[string]interface{}{"status": to}
+	if fulfillmentRank(to) > 0 {
+		updates["fulfillment_status"] = to
+	}
+	if err := tx.Model(order).Updates(updates).Error; err != nil {
+		return fmt.Errorf("update order status: %w", err)
+	}
+
+	change := OrderStatusChange{
+		OrderID:    order.ID,
+		FromStatus: from,
+		ToStatus:   to,
+		Actor:      "system",
+		Note:       note,
+	}
+	if actor != nil {
+		change.ActorID = actor.ID
+		change.Actor = actor.Email
+	}
+	if err := tx.Create(&change).Error; err != nil {
+		return fmt.Errorf("record status change: %w", err)
+	}
+
+	order.Status = to
+	if fulfillmentRank(to) > 0 {
+		order.FulfillmentStatus = to
+	}
+	return nil
+}
+
+// updateOrderStatus applies a staff status change to an order, locking it
+// so concurrent changes are checked against the latest status
+func updateOrderStatus(orderID, to string, actor *User, note string) (*Order, error) {
+	if !staffStatuses[to] {
+		return nil, fmt.Errorf("%w: %s cannot be set by hand", ErrIllegalTransition, to)
+	}
+
+	var order Order
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", orderID).First(&order).Error
+		if err != nil {
+			return err
+		}
+		return transitionOrder(tx, &order, to, actor, note)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("User %s moved order %s to %s", actor.Email, orderID, to)
+	return &order, nil
+}
+
+// saveReconciledOrder saves the order's payment fields and moves it to the
+// status they imply: cancelled for a voided or failed payment, refunded or
+// partially_refunded once money has gone back. A status the lifecycle does
+// not allow from where the order is is logged and skipped.
+func saveReconciledOrder(tx *gorm.DB, order *Order, actor *User, note string) error {
+	err := tx.Model(order).Updates(map[string]interface{}{
+		"payment_status":  order.PaymentStatus,
+		"refunded_amount": order.RefundedAmount,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	var to string
+	switch {
+	case order.PaymentStatus == PaymentStatusCanceled || order.PaymentStatus == PaymentStatusFailed:
+		to = OrderStatusCancelled
+	case order.RefundedAmount >= order.Total && order.RefundedAmount > 0:
+		to = OrderStatusRefunded
+	case order.RefundedAmount > 0:
+		to = OrderStatusPartiallyRefunded
+	default:
+		return nil
+	}
+
+	err = transitionOrder(tx, order, to, actor, note)
+	if errors.Is(err, ErrIllegalTransition) {
+		log.Printf("Order %s left %s after payment update: %v", order.ID, order.Status, err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOrderCanMoveTo(t *testing.T) {
+	tests := []struct {
+		name  string
+		order Order
+		to    string
+		want  bool
+	}{
+		{"pending to paid", Order{Status: OrderStatusPending}, OrderStatusPaid, true},
+		{"paid to processing", Order{Status: OrderStatusPaid}, OrderStatusProcessing, true},
+		{"paid cannot skip to shipped", Order{Status: OrderStatusPaid}, OrderStatusShipped, false},
+		{"shipped to delivered", Order{Status: OrderStatusShipped, FulfillmentStatus: OrderStatusShipped}, OrderStatusDelivered, true},
+		{"shipped cannot go back to processing", Order{Status: OrderStatusShipped, FulfillmentStatus: OrderStatusShipped}, OrderStatusProcessing, false},
+		{"delivered to partially refunded", Order{Status: OrderStatusDelivered, FulfillmentStatus: OrderStatusDelivered}, OrderStatusPartiallyRefunded, true},
+		{"cancelled is final", Order{Status: OrderStatusCancelled}, OrderStatusPaid, false},
+		{"refunded is final", Order{Status: OrderStatusRefunded, FulfillmentStatus: OrderStatusShipped}, OrderStatusDelivered, false},
+
+		// A partial refund keeps the order's place in fulfillment
+		{"partially refunded while paid may process", Order{Status: OrderStatusPartiallyRefunded, FulfillmentStatus: OrderStatusPaid}, OrderStatusProcessing, true},
+		{"partially refunded while processing may ship", Order{Status: OrderStatusPartiallyRefunded, FulfillmentStatus: OrderStatusProcessing}, OrderStatusShipped, true},
+		{"partially refunded while processing cannot skip to delivered", Order{Status: OrderStatusPartiallyRefunded, FulfillmentStatus: OrderStatusProcessing}, OrderStatusDelivered, false},
+		{"partially refunded while shipped cannot go back to processing", Order{Status: OrderStatusPartiallyRefunded, FulfillmentStatus: OrderStatusShipped}, OrderStatusProcessing, false},
+		{"partially refunded after delivery cannot go back to shipped", Order{Status: OrderStatusPartiallyRefunded, FulfillmentStatus: OrderStatusDelivered}, OrderStatusShipped, false},
+		{"partially refunded after delivery cannot be delivered again", Order{Status: OrderStatusPartiallyRefunded, FulfillmentStatus: OrderStatusDelivered}, OrderStatusDelivered, false},
+		{"partially refunded after delivery to refunded", Order{Status: OrderStatusPartiallyRefunded, FulfillmentStatus: OrderStatusDelivered}, OrderStatusRefunded, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.order.canMoveTo(tt.to); got != tt.want {
+				t.Errorf("canMoveTo(%s) from %s = %v, want %v", tt.to, tt.order.Status, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextStaffStatuses(t *testing.T) {
+	tests := []struct {
+		name  string
+		order Order
+		want  []string
+	}{
+		{"paid", Order{Status: OrderStatusPaid}, []string{OrderStatusProcessing}},
+		{"delivered", Order{Status: OrderStatusDelivered, FulfillmentStatus: OrderStatusDelivered}, nil},
+		{"partially refunded while processing", Order{Status: OrderStatusPartiallyRefunded, FulfillmentStatus: OrderStatusProcessing}, []string{OrderStatusShipped}},
+		{"partially refunded after delivery", Order{Status: OrderStatusPartiallyRefunded, FulfillmentStatus: OrderStatusDelivered}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.order.NextStaffStatuses(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NextStaffStatuses() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// passwordResetTTL is how long a reset link works
+	passwordResetTTL = time.Hour
+
+	// passwordResetInterval is the least time between reset emails to one
+	// account, so the form cannot be used to flood an inbox
+	passwordResetInterval = time.Minute
+)
+
+// forgotPasswordHandler shows the request-reset form and emails a reset
+// link. The response is the same whether or not the email is registered,
+// so the form cannot be used to discover accounts.
+func forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		tmpl := template.Must(template.ParseFiles("templates/forgot-password.html"))
+		tmpl.Execute(w, nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Email) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Email is required"})
+		return
+	}
+
+	var user User
+	if err := DB.Where("LOWER(email) = LOWER(?)", strings.TrimSpace(req.Email)).First(&user).Error; err == nil {
+		if err := sendPasswordReset(&user); err != nil {
+			log.Printf("Failed to start password reset for %s: %v", user.Email, err)
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "If an account exists for that email, we've sent a link to reset its password.",
+	})
+}
+
+// sendPasswordReset emails the user a new reset link, unless one was sent
+// within passwordResetInterval
+func sendPasswordReset(user *User) error {
+	recent, err := recentAccountToken(user.ID, TokenPasswordReset, passwordResetInterval)
+	if err != nil || recent {
+		return err
+	}
+
+	token, err := issueAccountToken(DB, user.ID, TokenPasswordReset, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "Hi %s,\n\n", user.Name)
+	body.WriteString("Someone asked to reset the password for your TechStore account. ")
+	body.WriteString("To choose a new password, open this link within the next hour:\n\n")
+	fmt.Fprintf(&body, "%s\n\n", emailLink("/reset-password?token="+url.QueryEscape(token)))
+	body.WriteString("The link works once. If you didn't ask for this, you can ignore this email; ")
+	body.WriteString("your password has not been changed.\n")
+
+	sendEmail(EmailMessage{
+		To:      user.Email,
+		Subject: "Reset your TechStore password",
+		Body:    body.String(),
+	})
+	return nil
+}
+
+// resetPasswordHandler shows the choose-a-new-password form for a reset
+// link and applies it. Resetting signs the account out everywhere.
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		// The form needs the email to hash the new password the way the
+		// login form will
+		data := map[string]interface{}{"Token": r.URL.Query().Get("token")}
+		if token, err := findAccountToken(DB, r.URL.Query().Get("token"), TokenPasswordReset); err == nil {
+			var user User
+			if DB.Where("id = ?", token.UserID).First(&user).Error == nil {
+				data["Email"] = user.Email
+			}
+		}
+
+		tmpl := template.Must(template.ParseFiles("templates/reset-password.html"))
+		tmpl.Execute(w, data)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"` // Already hashed with PBKDF2 from client
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+
+	hashedPassword, err := HashPassword(req.Password)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Server error"})
+		return
+	}
+
+	var user User
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		token, err := redeemAccountToken(tx, req.Token, TokenPasswordReset)
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("id = ?", token.UserID).First(&user).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&user).Update("password_hash", hashedPassword).Error; err != nil {
+			return err
+		}
+		return revokeSessions(tx, user.ID)
+	})
+	if errors.Is(err, ErrInvalidAccountToken) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": invalidLinkMessage})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to reset password: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to reset password"})
+		return
+	}
+	log.Printf("User %s reset their password", user.Email)
+
+	sendEmail(EmailMessage{
+		To:      user.Email,
+		Subject: "Your TechStore password was changed",
+		Body: fmt.Sprintf("Hi %s,\n\nThe password for your TechStore account was just reset, and you have been "+
+			"signed out on all devices.\n\nIf this wasn't you, reset your password again at %s and contact support.\n",
+			user.Name, emailLink("/forgot-password")),
+	})
+
+	clearAuthCookies(w)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Your password has been reset. Please sign in with your new password.",
+	})
+}
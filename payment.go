@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Payment statuses (mirrors Square's payment status values)
+const (
+	PaymentStatusApproved  = "APPROVED"
+	PaymentStatusCompleted = "COMPLETED"
+	PaymentStatusCanceled  = "CANCELED"
+	PaymentStatusFailed    = "FAILED"
+)
+
+// Refund statuses (mirrors Square's refund status values)
+const (
+	RefundStatusPending   = "PENDING"
+	RefundStatusCompleted = "COMPLETED"
+	RefundStatusRejected  = "REJECTED"
+	RefundStatusFailed    = "FAILED"
+)
+
+// ErrPaymentDeclined is returned when the processor rejects the payment source
+var ErrPaymentDeclined = errors.New("payment declined")
+
+// PaymentRequest describes a charge to authorize
+type PaymentRequest struct {
+	SourceID       string
+	IdempotencyKey string
+	Amount         int64 // in cents
+	Currency       string
+	BuyerEmail     string
+	Note           string
+}
+
+// PaymentResult is the processor's view of a payment
+type PaymentResult struct {
+	PaymentID string
+	Status    string
+	Amount    int64 // in cents
+}
+
+// RefundResult is the processor's view of a refund
+type RefundResult struct {
+	RefundID string
+	Status   string
+	Amount   int64 // in cents
+}
+
+// PaymentProvider abstracts the payment processor used at checkout
+type PaymentProvider interface {
+	// Name identifies the provider ("square", "fake")
+	Name() string
+	// Authorize places a hold on the payment source without capturing funds
+	Authorize(req PaymentRequest) (*PaymentResult, error)
+	// Capture completes a previously authorized payment
+	Capture(paymentID string) (*PaymentResult, error)
+	// Void cancels an authorized payment that has not been captured
+	Void(paymentID string) (*PaymentResult, error)
+	// Refund returns part or all of a captured payment
+	Refund(paymentID string, amount int64, idempotencyKey, reason string) (*RefundResult, error)
+	// GetStatus fetches the current state of a payment
+	GetStatus(paymentID string) (*PaymentResult, error)
+}
+
+// Payments is the provider selected by PAYMENT_PROVIDER
+var Payments PaymentProvider
+
+// InitPayments selects the payment provider from the environment
+func InitPayments() {
+	provider, err := newPaymentProvider(os.Getenv("PAYMENT_PROVIDER"))
+	if err != nil {
+		log.Fatalf("Failed to configure payments: %v", err)
+	}
+	Payments = provider
+	log.Printf("Payment provider: %s", Payments.Name())
+}
+
+func newPaymentProvider(name string) (PaymentProvider, error) {
+	switch strings.ToLower(name) {
+	case "", "square":
+		return newSquareProvider(), nil
+	case "fake":
+		return newFakeProvider(), nil
+	default:
+		return nil, fmt.Errorf("unknown PAYMENT_PROVIDER %q", name)
+	}
+}
+
+// squareProvider talks to the Square Payments API over HTTP
+type squareProvider struct {
+	baseURL     string
+	accessToken string
+	locationID  string
+	client      *http.Client
+}
+
+func newSquareProvider() *squareProvider {
+	// Determine API endpoint based on environment
+	baseURL := "https://connect.squareup.com"
+	if os.Getenv("SQUARE_ENVIRONMENT") == "sandbox" {
+		baseURL = "https://connect.squareupsandbox.com"
+	}
+
+	return &squareProvider{
+		baseURL:     baseURL,
+		accessToken: os.Getenv("SQUARE_ACCESS_TOKEN"),
+		locationID:  os.Getenv("SQUARE_LOCATION_ID"),
+		client:      &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *squareProvider) Name() string { return "square" }
+
+// squarePayment is the subset of Square's Payment object we use
+type squarePayment struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"`
+	AmountMoney struct {
+		Amount   int64  `json:"amount"`
+		Currency string `json:"currency"`
+	} `json:"amount_money"`
+}
+
+func (p squarePayment) result() *PaymentResult {
+	return &PaymentResult{PaymentID: p.ID, Status: p.Status, Amount: p.AmountMoney.Amount}
+}
+
+// squareRefund is the subset of Square's PaymentRefund object we use
+type squareRefund struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"`
+	PaymentID   string `json:"payment_id"`
+	AmountMoney struct {
+		Amount int64 `json:"amount"`
+	} `json:"amount_money"`
+}
+
+func (r squareRefund) result() *RefundResult {
+	return &RefundResult{RefundID: r.ID, Status: r.Status, Amount: r.AmountMoney.Amount}
+}
+
+func (s *squareProvider) Authorize(req PaymentRequest) (*PaymentResult, error) {
+	currency := req.Currency
+	if currency == "" {
+		currency = "USD"
+	}
+
+	body := map[string]interface{}{
+		"source_id":       req.SourceID,
+		"idempotency_key": req.IdempotencyKey,
+		"amount_money": map[string]interface{}{
+			"amount":   req.Amount,
+			"currency": currency,
+		},
+		"location_id":  s.locationID,
+		"autocomplete": false,
+	}
+	if req.BuyerEmail != "" {
+		body["buyer_email_address"] = req.BuyerEmail
+	}
+	if req.Note != "" {
+		body["note"] = req.Note
+	}
+
+	var resp struct {
+		Payment squarePayment `json:"payment"`
+	}
+	if err := s.do(http.MethodPost, "/v2/payments", body, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Payment.result(), nil
+}
+
+func (s *squareProvider) Capture(paymentID string) (*PaymentResult, error) {
+	var resp struct {
+		Payment squarePayment `json:"payment"`
+	}
+	if err := s.do(http.MethodPost, "/v2/payments/"+paymentID+"/complete", map[string]interface{}{}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Payment.result(), nil
+}
+
+func (s *squareProvider) Void(paymentID string) (*PaymentResult, error) {
+	var resp struct {
+		Payment squarePayment `json:"payment"`
+	}
+	if err := s.do(http.MethodPost, "/v2/payments/"+paymentID+"/cancel", map[string]interface{}{}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Payment.result(), nil
+}
+
+func (s *squareProvider) Refund(paymentID string, amount int64, idempotencyKey, reason string) (*RefundResult, error) {
+	// Square only refunds in the currency the payment was taken in
+	payment, err := s.payment(paymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	body := map[string]interface{}{
+		"idempotency_key": idempotencyKey,
+		"payment_id":      paymentID,
+		"amount_money": map[string]interface{}{
+			"amount":   amount,
+			"currency": payment.AmountMoney.Currency,
+		},
+	}
+	if reason != "" {
+		body["reason"] = reason
+	}
+
+	var resp struct {
+		Refund squareRefund `json:"refund"`
+	}
+	if err := s.do(http.MethodPost, "/v2/refunds", body, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Refund.result(), nil
+}
+
+func (s *squareProvider) GetStatus(paymentID string) (*PaymentResult, error) {
+	payment, err := s.payment(paymentID)
+	if err != nil {
+		return nil, err
+	}
+	return payment.result(), nil
+}
+
+// payment fetches a payment from the Square API
+func (s *squareProvider) payment(paymentID string) (*squarePayment, error) {
+	var resp struct {
+		Payment squarePayment `json:"payment"`
+	}
+	if err := s.do(http.MethodGet, "/v2/payments/"+paymentID, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Payment, nil
+}
+
+// do sends a request to the Square API and decodes the JSON response into out
+func (s *squareProvider) do(method, path string, body interface{}, out interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, s.baseURL+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.accessToken)
+	req.Header.Set("Square-Version", "2024-12-18")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Errors []struct {
+				Category string `json:"category"`
+				Code     string `json:"code"`
+				Detail   string `json:"detail"`
+			} `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		log.Printf("Square API %s %s failed (%d): %+v", method, path, resp.StatusCode, apiErr.Errors)
+
+		if len(apiErr.Errors) > 0 && apiErr.Errors[0].Category == "PAYMENT_METHOD_ERROR" {
+			return fmt.Errorf("%w: %s", ErrPaymentDeclined, apiErr.Errors[0].Code)
+		}
+		return fmt.Errorf("square API returned status %d", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Source IDs understood by the fake provider. Square's sandbox test nonces
+// are accepted too so the same values work against either backend.
+const (
+	FakeSourceOK       = "fake-card-ok"
+	FakeSourceDeclined = "fake-card-declined"
+)
+
+// fakeProvider is a deterministic in-process payment backend for tests and
+// local development without Square credentials
+type fakeProvider struct {
+	mu       sync.Mutex
+	seq      int
+	payments map[string]*fakePayment
+	refunds  map[string]*RefundResult
+	byKey    map[string]string // idempotency key -> payment/refund ID
+}
+
+type fakePayment struct {
+	PaymentResult
+	refunded int64
+}
+
+func newFakeProvider() *fakeProvider {
+	return &fakeProvider{
+		payments: make(map[string]*fakePayment),
+		refunds:  make(map[string]*RefundResult),
+		byKey:    make(map[string]string),
+	}
+}
+
+func (f *fakeProvider) Name() string { return "fake" }
+
+func (f *fakeProvider) nextID(prefix string) string {
+	f.seq++
+	return fmt.Sprintf("%s_%06d", prefix, f.seq)
+}
+
+func (f *fakeProvider) Authorize(req PaymentRequest) (*PaymentResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Replay of the same idempotency key returns the original payment
+	if id, ok := f.byKey[req.IdempotencyKey]; ok && req.IdempotencyKey != "" {
+		p := f.payments[id].PaymentResult
+		return &p, nil
+	}
+
+	switch req.SourceID {
+	case FakeSourceDeclined, "cnon:card-nonce-declined":
+		return nil, fmt.Errorf("%w: CARD_DECLINED", ErrPaymentDeclined)
+	case "":
+		return nil, fmt.Errorf("%w: missing source", ErrPaymentDeclined)
+	}
+	if req.Amount <= 0 {
+		return nil, fmt.Errorf("invalid amount %d", req.Amount)
+	}
+
+	p := &fakePayment{PaymentResult: PaymentResult{
+		PaymentID: f.nextID("fake_pay"),
+		Status:    PaymentStatusApproved,
+		Amount:    req.Amount,
+	}}
+	f.payments[p.PaymentID] = p
+	if req.IdempotencyKey != "" {
+		f.byKey[req.IdempotencyKey] = p.PaymentID
+	}
+
+	result := p.PaymentResult
+	return &result, nil
+}
+
+func (f *fakeProvider) Capture(paymentID string) (*PaymentResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, ok := f.payments[paymentID]
+	if !ok {
+		return nil, fmt.Errorf("payment %s not found", paymentID)
+	}
+	if p.Status != PaymentStatusApproved && p.Status != PaymentStatusCompleted {
+		return nil, fmt.Errorf("payment %s cannot be captured in status %s", paymentID, p.Status)
+	}
+	p.Status = PaymentStatusCompleted
+
+	result := p.PaymentResult
+	return &result, nil
+}
+
+func (f *fakeProvider) Void(paymentID string) (*PaymentResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, ok := f.payments[paymentID]
+	if !ok {
+		return nil, fmt.Errorf("payment %s not found", paymentID)
+	}
+	if p.Status != PaymentStatusApproved {
+		return nil, fmt.Errorf("payment %s cannot be voided in status %s", paymentID, p.Status)
+	}
+	p.Status = PaymentStatusCanceled
+
+	result := p.PaymentResult
+	return &result, nil
+}
+
+func (f *fakeProvider) Refund(paymentID string, amount int64, idempotencyKey, reason string) (*RefundResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Replay of the same idempotency key returns the original refund
+	if id, ok := f.byKey[idempotencyKey]; ok && idempotencyKey != "" {
+		if refund, ok := f.refunds[id]; ok {
+			result := *refund
+			return &result, nil
+		}
+	}
+
+	p, ok := f.payments[paymentID]
+	if !ok {
+		return nil, fmt.Errorf("payment %s not found", paymentID)
+	}
+	if p.Status != PaymentStatusCompleted {
+		return nil, fmt.Errorf("payment %s cannot be refunded in status %s", paymentID, p.Status)
+	}
+	if amount <= 0 || p.refunded+amount > p.Amount {
+		return nil, fmt.Errorf("refund of %d exceeds refundable amount %d", amount, p.Amount-p.refunded)
+	}
+	p.refunded += amount
+
+	refund := &RefundResult{RefundID: f.nextID("fake_refund"), Status: RefundStatusCompleted, Amount: amount}
+	f.refunds[refund.RefundID] = refund
+	if idempotencyKey != "" {
+		f.byKey[idempotencyKey] = refund.RefundID
+	}
+
+	result := *refund
+	return &result, nil
+}
+
+func (f *fakeProvider) GetStatus(paymentID string) (*PaymentResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, ok := f.payments[paymentID]
+	if !ok {
+		return nil, fmt.Errorf("payment %s not found", paymentID)
+	}
+	result := p.PaymentResult
+	return &result, nil
+}
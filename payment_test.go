@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSquareRefundUsesPaymentCurrency(t *testing.T) {
+	var refundCurrency string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /v2/payments/pay_cad":
+			w.Write([]byte(`{"payment": {"id": "pay_cad", "status": "COMPLETED", "amount_money": {"amount": 5000, "currency": "CAD"}}}`))
+		case "POST /v2/refunds":
+			var body struct {
+				AmountMoney struct {
+					Currency string `json:"currency"`
+				} `json:"amount_money"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			refundCurrency = body.AmountMoney.Currency
+			w.Write([]byte(`{"refund": {"id": "ref_1", "status": "PENDING", "payment_id": "pay_cad", "amount_money": {"amount": 1500, "currency": "CAD"}}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	provider := &squareProvider{baseURL: server.URL, client: server.Client()}
+	result, err := provider.Refund("pay_cad", 1500, "refund-key", "")
+	if err != nil {
+		t.Fatalf("Refund: %v", err)
+	}
+	if refundCurrency != "CAD" {
+		t.Errorf("refund currency = %q, want CAD", refundCurrency)
+	}
+	if result.RefundID != "ref_1" || result.Amount != 1500 {
+		t.Errorf("refund = %+v, want ref_1 for 1500", result)
+	}
+}
+
+func TestFakeRefundReplayReturnsOriginal(t *testing.T) {
+	fake := newFakeProvider()
+	payment, err := fake.Authorize(PaymentRequest{SourceID: FakeSourceOK, Amount: 5000, Currency: "USD"})
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	if _, err := fake.Capture(payment.PaymentID); err != nil {
+		t.Fatalf("Capture: %v", err)
+	}
+
+	first, err := fake.Refund(payment.PaymentID, 1500, "refund-key", "")
+	if err != nil {
+		t.Fatalf("Refund: %v", err)
+	}
+	replay, err := fake.Refund(payment.PaymentID, 2500, "refund-key", "")
+	if err != nil {
+		t.Fatalf("replayed Refund: %v", err)
+	}
+
+	if *replay != *first {
+		t.Errorf("replay = %+v, want the original %+v", replay, first)
+	}
+	if got := fake.payments[payment.PaymentID].refunded; got != 1500 {
+		t.Errorf("refunded %d, want 1500 refunded once", got)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import "errors"
+
+// LineAmount returns the value of a cart line at current prices
+func (i CartItem) LineAmount() int64 {
+	return i.UnitPrice() * int64(i.Quantity)
+}
+
+// PricedLine is a cart line with its share of the discount and tax
+type PricedLine struct {
+	CartItem
+	Discount int64
+	Tax      int64
+}
+
+// Total returns what the customer pays for the line, before shipping
+func (l PricedLine) Total() int64 {
+	return l.LineAmount() - l.Discount + l.Tax
+}
+
+// PricedCart holds every amount shown for a cart and charged for it. The
+// cart page, checkout and payment all price through priceCart, so what the
+// customer sees is what the card is charged.
+type PricedCart struct {
+	Lines         []PricedLine
+	Subtotal      int64
+	ShippingRates []ShippingRate // methods that can carry the cart, when shipping was priced
+	Shipping      ShippingRate   // the selected method
+	Discount      CouponDiscount
+	CouponError   string // why the requested coupon was not applied
+	Tax           TaxResult
+	Total         int64
+}
+
+// Items returns the cart lines that were priced
+func (p PricedCart) Items() []CartItem {
+	items := make([]CartItem, len(p.Lines))
+	for i, line := range p.Lines {
+		items[i] = line.CartItem
+	}
+	return items
+}
+
+// pricingOptions says how far to price a cart
+type pricingOptions struct {
+	UserID     string        // for per-customer coupon limits; empty for guests
+	CouponCode string        // empty for no coupon
+	ShipTo     PostalAddress // decides the tax; without a country no tax is charged
+
+	// Shipping prices the shipping methods and selects ShippingMethodID,
+	// or the first method offered when that is not available
+	Shipping         bool
+	ShippingMethodID string
+
+	// Strict is for charging: an unavailable shipping method or a coupon
+	// that does not apply is an error instead of being passed over
+	Strict bool
+}
+
+// priceCart works out the subtotal, coupon discount, shipping, tax and
+// grand total of a cart. In strict mode it returns ErrShippingUnavailable
+// or a *CouponError when the customer's choices cannot be honored; any
+// other error means the prices could not be loaded.
+func priceCart(items []CartItem, opts pricingOptions) (PricedCart, error) {
+	var priced PricedCart
+	for _, item := range items {
+		priced.Lines = append(priced.Lines, PricedLine{CartItem: item})
+		priced.Subtotal += item.LineAmount()
+	}
+
+	if opts.Shipping {
+		rates, err := shippingRates(items, priced.Subtotal)
+		if err != nil {
+			return priced, err
+		}
+		priced.ShippingRates = rates
+
+		shipping, ok := selectShippingRate(rates, opts.ShippingMethodID)
+		if opts.Strict && (!ok || shipping.MethodID != opts.ShippingMethodID) {
+			return priced, ErrShippingUnavailable
+		}
+		priced.Shipping = shipping
+	}
+
+	discount, err := applyCoupon(opts.CouponCode, opts.UserID, items, priced.Subtotal, priced.Shipping.Cost)
+	if err != nil {
+		var couponErr *CouponError
+		if opts.Strict || !errors.As(err, &couponErr) {
+			return priced, err
+		}
+		priced.CouponError = couponErr.Error()
+	}
+	priced.Discount = discount
+
+	tax, err := calculateTax(items, discount.ItemAmounts, opts.ShipTo)
+	if err != nil {
+		return priced, err
+	}
+	priced.Tax = tax
+
+	for i := range priced.Lines {
+		priced.Lines[i].Discount = discount.ItemAmounts[i]
+		priced.Lines[i].Tax = tax.ItemAmounts[i]
+	}
+	priced.Total = priced.Subtotal - discount.Total() + priced.Shipping.Cost + tax.Total
+	return priced, nil
+}
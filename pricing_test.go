@@ -0,0 +1,214 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// seedPricingCart adds the shipping methods, tax rates and coupons the
+// pricing tests use, and returns a cart of a keyboard, cables and an ebook
+func seedPricingCart(t *testing.T) []CartItem {
+	t.Helper()
+
+	accessories := Category{ID: uuid.New().String(), Name: "Accessories", Slug: "accessories"}
+	cables := Category{ID: uuid.New().String(), Name: "Cables", Slug: "cables", ParentID: &accessories.ID}
+	computers := Category{ID: uuid.New().String(), Name: "Computers", Slug: "computers"}
+	for _, category := range []*Category{&accessories, &cables, &computers} {
+		if err := DB.Create(category).Error; err != nil {
+			t.Fatalf("create category %s: %v", category.Name, err)
+		}
+	}
+
+	keyboard := createTestProduct(t, Product{Name: "Keyboard", Price: 4999, Stock: 10, WeightGrams: 800, CategoryID: &computers.ID})
+	cable := createTestProduct(t, Product{Name: "USB-C Cable", Price: 1299, Stock: 10, WeightGrams: 100, CategoryID: &cables.ID})
+	ebook := createTestProduct(t, Product{Name: "Go Handbook", Price: 1000, Stock: 10, TaxCategory: TaxReduced})
+
+	methods := []ShippingMethod{
+		{ID: "standard", Name: "Standard", Kind: ShippingFreeOver, BaseRate: 599, FreeOver: 50000, SortOrder: 1, Active: true},
+		{ID: "express", Name: "Express", Kind: ShippingByWeight, BaseRate: 999, PerKgRate: 200, SortOrder: 2, Active: true},
+		{ID: "courier", Name: "Courier", Kind: ShippingFlat, BaseRate: 2500, MaxWeightGrams: 1000, SortOrder: 3, Active: true},
+		{ID: "pickup", Name: "Pickup", Kind: ShippingFlat, SortOrder: 0, Active: false},
+	}
+	if err := DB.Create(&methods).Error; err != nil {
+		t.Fatalf("create shipping methods: %v", err)
+	}
+
+	rates := []TaxRate{
+		{Name: "GST", Country: "CA", Category: TaxStandard, Rate: 5000},
+		{Name: "GST", Country: "CA", Category: TaxReduced, Rate: 5000},
+		{Name: "QST", Country: "CA", Region: "QC", Category: TaxStandard, Rate: 9975},
+	}
+	if err := DB.Create(&rates).Error; err != nil {
+		t.Fatalf("create tax rates: %v", err)
+	}
+
+	coupons := []Coupon{
+		{ID: uuid.New().String(), Code: "TENOFF", Kind: CouponPercent, Value: 10, Active: true},
+		{ID: uuid.New().String(), Code: "TWENTY", Kind: CouponFixed, Value: 2000, Active: true},
+		{ID: uuid.New().String(), Code: "SHIPFREE", Kind: CouponFreeShipping, Active: true},
+		{ID: uuid.New().String(), Code: "CABLES50", Kind: CouponFixed, Value: 5000, Active: true, Products: []Product{*cable}},
+		{ID: uuid.New().String(), Code: "ACCESSORIES20", Kind: CouponPercent, Value: 20, Active: true, Categories: []Category{accessories}},
+	}
+	for i := range coupons {
+		if err := DB.Create(&coupons[i]).Error; err != nil {
+			t.Fatalf("create coupon %s: %v", coupons[i].Code, err)
+		}
+	}
+
+	return []CartItem{
+		{ProductID: keyboard.ID, Product: *keyboard, Quantity: 2},
+		{ProductID: cable.ID, Product: *cable, Quantity: 3},
+		{ProductID: ebook.ID, Product: *ebook, Quantity: 1},
+	}
+}
+
+func TestPriceCart(t *testing.T) {
+	useTestDatabase(t)
+	items := seedPricingCart(t)
+
+	canada := PostalAddress{Country: "CA"}
+	quebec := PostalAddress{Country: "CA", Region: "QC"}
+
+	// The cart is 2 x 49.99 + 3 x 12.99 + 10.00 = 148.95, weighing 1.9 kg
+	tests := []struct {
+		name  string
+		opts  pricingOptions
+		want  PricedCart
+		lines [][2]int64 // discount and tax of each line
+	}{
+		{
+			name:  "no coupon, shipping or tax",
+			opts:  pricingOptions{},
+			want:  PricedCart{Subtotal: 14895, Total: 14895},
+			lines: [][2]int64{{0, 0}, {0, 0}, {0, 0}},
+		},
+		{
+			name:  "first shipping method offered by default",
+			opts:  pricingOptions{Shipping: true},
+			want:  PricedCart{Subtotal: 14895, Shipping: ShippingRate{MethodID: "standard", Cost: 599}, Total: 15494},
+			lines: [][2]int64{{0, 0}, {0, 0}, {0, 0}},
+		},
+		{
+			name:  "chosen shipping method priced by weight",
+			opts:  pricingOptions{Shipping: true, ShippingMethodID: "express"},
+			want:  PricedCart{Subtotal: 14895, Shipping: ShippingRate{MethodID: "express", Cost: 1399}, Total: 16294},
+			lines: [][2]int64{{0, 0}, {0, 0}, {0, 0}},
+		},
+		{
+			name:  "method too small for the cart falls back to the first offered",
+			opts:  pricingOptions{Shipping: true, ShippingMethodID: "courier"},
+			want:  PricedCart{Subtotal: 14895, Shipping: ShippingRate{MethodID: "standard", Cost: 599}, Total: 15494},
+			lines: [][2]int64{{0, 0}, {0, 0}, {0, 0}},
+		},
+		{
+			// 5% of 99.98 is 4.999 and of 38.97 is 1.9485, both rounding up
+			name:  "country rate only",
+			opts:  pricingOptions{ShipTo: canada},
+			want:  PricedCart{Subtotal: 14895, Tax: TaxResult{Total: 745}, Total: 15640},
+			lines: [][2]int64{{0, 500}, {0, 195}, {0, 50}},
+		},
+		{
+			// 9.975% of 99.98 is 9.973, of 38.97 is 3.8873; the ebook is
+			// reduced rate, which QST does not cover
+			name:  "country and region rates",
+			opts:  pricingOptions{ShipTo: quebec, Shipping: true, ShippingMethodID: "express"},
+			want:  PricedCart{Subtotal: 14895, Shipping: ShippingRate{MethodID: "express", Cost: 1399}, Tax: TaxResult{Total: 2131}, Total: 18425},
+			lines: [][2]int64{{0, 500 + 997}, {0, 195 + 389}, {0, 50}},
+		},
+		{
+			name:  "percent coupon",
+			opts:  pricingOptions{CouponCode: "tenoff"},
+			want:  PricedCart{Subtotal: 14895, Discount: CouponDiscount{Items: 1488}, Total: 13407},
+			lines: [][2]int64{{999, 0}, {389, 0}, {100, 0}},
+		},
+		{
+			// $20 is split in proportion to line value, the last line
+			// taking the rounding, and tax is charged on what is left
+			name:  "fixed coupon with tax",
+			opts:  pricingOptions{CouponCode: "TWENTY", ShipTo: quebec},
+			want:  PricedCart{Subtotal: 14895, Discount: CouponDiscount{Items: 2000}, Tax: TaxResult{Total: 1845}, Total: 14740},
+			lines: [][2]int64{{1342, 433 + 863}, {523, 169 + 337}, {135, 43}},
+		},
+		{
+			name:  "free shipping coupon",
+			opts:  pricingOptions{CouponCode: "SHIPFREE", Shipping: true},
+			want:  PricedCart{Subtotal: 14895, Shipping: ShippingRate{MethodID: "standard", Cost: 599}, Discount: CouponDiscount{Shipping: 599}, Total: 14895},
+			lines: [][2]int64{{0, 0}, {0, 0}, {0, 0}},
+		},
+		{
+			name:  "fixed coupon capped at the eligible lines",
+			opts:  pricingOptions{CouponCode: "CABLES50"},
+			want:  PricedCart{Subtotal: 14895, Discount: CouponDiscount{Items: 3897}, Total: 10998},
+			lines: [][2]int64{{0, 0}, {3897, 0}, {0, 0}},
+		},
+		{
+			// The cables are in a subcategory of accessories
+			name:  "category coupon",
+			opts:  pricingOptions{CouponCode: "ACCESSORIES20"},
+			want:  PricedCart{Subtotal: 14895, Discount: CouponDiscount{Items: 779}, Total: 14116},
+			lines: [][2]int64{{0, 0}, {779, 0}, {0, 0}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := priceCart(items, tt.opts)
+			if err != nil {
+				t.Fatalf("priceCart: %v", err)
+			}
+			if got.CouponError != "" {
+				t.Fatalf("coupon not applied: %s", got.CouponError)
+			}
+
+			if got.Subtotal != tt.want.Subtotal {
+				t.Errorf("Subtotal = %d, want %d", got.Subtotal, tt.want.Subtotal)
+			}
+			if got.Discount.Items != tt.want.Discount.Items || got.Discount.Shipping != tt.want.Discount.Shipping {
+				t.Errorf("Discount = %d on items and %d on shipping, want %d and %d",
+					got.Discount.Items, got.Discount.Shipping, tt.want.Discount.Items, tt.want.Discount.Shipping)
+			}
+			if got.Shipping.MethodID != tt.want.Shipping.MethodID || got.Shipping.Cost != tt.want.Shipping.Cost {
+				t.Errorf("Shipping = %s at %d, want %s at %d",
+					got.Shipping.MethodID, got.Shipping.Cost, tt.want.Shipping.MethodID, tt.want.Shipping.Cost)
+			}
+			if got.Tax.Total != tt.want.Tax.Total {
+				t.Errorf("Tax = %d, want %d", got.Tax.Total, tt.want.Tax.Total)
+			}
+			if got.Total != tt.want.Total {
+				t.Errorf("Total = %d, want %d", got.Total, tt.want.Total)
+			}
+
+			lines := make([][2]int64, len(got.Lines))
+			for i, line := range got.Lines {
+				lines[i] = [2]int64{line.Discount, line.Tax}
+			}
+			if !reflect.DeepEqual(lines, tt.lines) {
+				t.Errorf("line discounts and taxes = %v, want %v", lines, tt.lines)
+			}
+
+			// The per-line amounts must account for the cart totals exactly
+			var subtotal, discount, tax, total int64
+			for i, line := range got.Lines {
+				subtotal += line.LineAmount()
+				discount += got.Discount.ItemAmounts[i]
+				tax += got.Tax.ItemAmounts[i]
+				total += line.Total()
+			}
+			if subtotal != got.Subtotal {
+				t.Errorf("lines add up to a subtotal of %d, not %d", subtotal, got.Subtotal)
+			}
+			if discount != got.Discount.Items {
+				t.Errorf("line discounts add up to %d, not %d", discount, got.Discount.Items)
+			}
+			if tax != got.Tax.Total {
+				t.Errorf("line taxes add up to %d, not %d", tax, got.Tax.Total)
+			}
+			if total+got.Shipping.Cost-got.Discount.Shipping != got.Total {
+				t.Errorf("lines and shipping add up to %d, not %d",
+					total+got.Shipping.Cost-got.Discount.Shipping, got.Total)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Permissions grantable to roles
+const (
+	PermManageProducts = "products:manage"
+	PermViewAllOrders  = "orders:view_all"
+	PermManageOrders   = "orders:manage"
+	PermRefundOrders   = "orders:refund"
+	PermManageUsers    = "users:manage"
+)
+
+// rolePermissions maps each role to the permissions it grants. Customers
+// have no privileged permissions; they may only act on their own data.
+var rolePermissions = map[string][]string{
+	RoleCustomer: {},
+	RoleSupport: {
+		PermViewAllOrders,
+		PermManageOrders,
+	},
+	RoleAdmin: {
+		PermManageProducts,
+		PermViewAllOrders,
+		PermManageOrders,
+		PermRefundOrders,
+		PermManageUsers,
+	},
+}
+
+// validRole reports whether role is one of the known roles
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// HasRole reports whether the user holds any of the given roles
+func (u *User) HasRole(roles ...string) bool {
+	for _, role := range roles {
+		if u.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether the user's role grants a permission
+func (u *User) Can(permission string) bool {
+	for _, p := range rolePermissions[u.Role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// IsStaff reports whether the user has any privileged permission
+func (u *User) IsStaff() bool {
+	return len(rolePermissions[u.Role]) > 0
+}
+
+// requireRole restricts a route to users holding one of the given roles
+func requireRole(roles []string, next http.HandlerFunc) http.HandlerFunc {
+	return requireUser(func(u *User) bool { return u.HasRole(roles...) }, next)
+}
+
+// requirePermission restricts a route to users whose role grants permission
+func requirePermission(permission string, next http.HandlerFunc) http.HandlerFunc {
+	return requireUser(func(u *User) bool { return u.Can(permission) }, next)
+}
+
+// requireUser wraps authMiddleware and rejects authenticated users for whom
+// allowed returns false
+func requireUser(allowed func(*User) bool, next http.HandlerFunc) http.HandlerFunc {
+	return authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		user, err := getCurrentUser(r)
+		if err != nil || !allowed(user) {
+			if isAPIRequest(r) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Forbidden"})
+				return
+			}
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		// Privileges wait until the account is protected by 2FA
+		if user.NeedsTwoFactorSetup() {
+			if isAPIRequest(r) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]string{"error": twoFactorRequiredMessage})
+				return
+			}
+			http.Redirect(w, r, "/profile#two-factor", http.StatusSeeOther)
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+// adminUserRoleHandler changes a user's role
+//
+//	POST /api/admin/users/role {"email": "...", "role": "support"}
+func adminUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+
+	if !validRole(req.Role) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unknown role"})
+		return
+	}
+
+	var target User
+	if err := DB.Where("email = ?", strings.TrimSpace(req.Email)).First(&target).Error; err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		return
+	}
+
+	// Stop admins from locking themselves out of user management
+	actor, err := getCurrentUser(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+		return
+	}
+	if actor.ID == target.ID && req.Role != RoleAdmin {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "You cannot remove your own admin role"})
+		return
+	}
+
+	if err := DB.Model(&target).Update("role", req.Role).Error; err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update role"})
+		return
+	}
+	log.Printf("User %s changed role of %s to %s", actor.Email, target.Email, req.Role)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"user": map[string]string{
+			"id":    target.ID,
+			"email": target.Email,
+			"role":  target.Role,
+		},
+	})
+}
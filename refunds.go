@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrInvalidRefund is returned for refund requests that do not fit the order
+	ErrInvalidRefund = errors.New("invalid refund")
+	// ErrNotRefundable is returned when the order's payment cannot be refunded
+	ErrNotRefundable = errors.New("order cannot be refunded")
+)
+
+// RefundLine asks for Quantity units of one order line back
+type RefundLine struct {
+	OrderItemID uint `json:"order_item_id"`
+	Quantity    int  `json:"quantity"`
+}
+
+// RefundRequest describes a refund to issue. Without Lines the whole
+// remaining balance of the order is refunded.
+type RefundRequest struct {
+	Lines   []RefundLine `json:"items"`
+	Reason  string       `json:"reason"`
+	Restock bool         `json:"restock"`
+}
+
+// refundOrder refunds an order through the payment provider, records the
+// refund and its lines, and optionally puts the returned units back in
+// stock. The refund is recorded as pending with the order row locked, so
+// concurrent refunds cannot exceed what was paid, and committed before the
+// provider is called; submitRefund then records the outcome.
+func refundOrder(orderID string, req RefundRequest, actor *User) (*Refund, error) {
+	var order *Order
+	var refund *Refund
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		order, err = lockOrder(tx, "id = ?", orderID)
+		if err != nil {
+			return err
+		}
+		refund, err = recordRefund(tx, order, req, actor)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = submitRefund(order, refund, func(tx *gorm.DB, order *Order) error {
+		return saveReconciledOrder(tx, order, actor, refundNote(req.Reason))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("User %s refunded %d cents on order %s", actor.Email, refund.Amount, orderID)
+	return refund, nil
+}
+
+// lockOrder loads the order matching the condition with its items, locking
+// the order row until the transaction ends
+func lockOrder(tx *gorm.DB, query string, args ...interface{}) (*Order, error) {
+	var order Order
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where(query, args...).First(&order).Error
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Where("order_id = ?", order.ID).Order("id").Find(&order.Items).Error; err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// recordRefund validates a refund against the order and writes it as
+// pending, marking its lines refunded (and restocked if requested) and
+// updating the order's refunded amount. The caller must lock the order and,
+// once the transaction commits, finish with submitRefund.
+func recordRefund(tx *gorm.DB, order *Order, req RefundRequest, actor *User) (*Refund, error) {
+	if order.PaymentID == "" || order.PaymentStatus != PaymentStatusCompleted {
+		return nil, ErrNotRefundable
+	}
+
+	items, amount, err := refundItemsFor(order, req.Lines)
+	if err != nil {
+		return nil, err
+	}
+
+	// A full refund returns whatever has not been refunded yet
+	if len(req.Lines) == 0 || amount > order.RefundableAmount() {
+		amount = order.RefundableAmount()
+	}
+	if amount <= 0 {
+		return nil, fmt.Errorf("%w: nothing left to refund", ErrInvalidRefund)
+	}
+
+	refund := &Refund{
+		ID:        uuid.New().String(),
+		OrderID:   order.ID,
+		Amount:    amount,
+		Status:    RefundStatusPending,
+		Reason:    req.Reason,
+		IssuedBy:  actor.ID,
+		Restocked: req.Restock,
+		Items:     items,
+	}
+	if err := tx.Create(refund).Error; err != nil {
+		return nil, fmt.Errorf("create refund: %w", err)
+	}
+
+	if err := applyRefundItems(tx, refund, 1); err != nil {
+		return nil, err
+	}
+	if err := updateRefundedAmount(tx, order); err != nil {
+		return nil, err
+	}
+	if err := tx.Model(order).Update("refunded_amount", order.RefundedAmount).Error; err != nil {
+		return nil, err
+	}
+	return refund, nil
+}
+
+// submitRefund sends a recorded refund to the payment provider, outside any
+// transaction, then stores the provider's refund ID and status and runs
+// complete with the order locked again. A refund the provider does not
+// issue is marked failed and its lines given back. If the outcome can't be
+// saved the refund stays pending until the provider's webhook settles it.
+func submitRefund(order *Order, refund *Refund, complete func(tx *gorm.DB, order *Order) error) error {
+	result, err := Payments.Refund(order.PaymentID, refund.Amount, refund.ID, refund.Reason)
+	if err == nil && refundFailed(result.Status) {
+		err = fmt.Errorf("processor returned %s", result.Status)
+	}
+	if err != nil {
+		if failErr := failRefund(order, refund); failErr != nil {
+			log.Printf("CRITICAL: refund %s of order %s failed but is still pending: %v", refund.ID, order.ID, failErr)
+		}
+		return fmt.Errorf("refund payment: %w", err)
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		locked, err := lockOrder(tx, "id = ?", order.ID)
+		if err != nil {
+			return err
+		}
+		*order = *locked
+
+		// A webhook may have settled the refund already
+		refund.ProviderRefundID = &result.RefundID
+		err = tx.Model(refund).Where("status = ?", RefundStatusPending).Updates(map[string]interface{}{
+			"provider_refund_id": refund.ProviderRefundID,
+			"status":             result.Status,
+		}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.First(refund, "id = ?", refund.ID).Error; err != nil {
+			return err
+		}
+
+		if err := updateRefundedAmount(tx, order); err != nil {
+			return err
+		}
+		return complete(tx, order)
+	})
+	if err != nil {
+		log.Printf("CRITICAL: refund %s issued for order %s but not recorded: %v", result.RefundID, order.ID, err)
+	}
+	return err
+}
+
+// failRefund marks a pending refund the provider did not issue as failed
+// and gives its lines back, restocked units included
+func failRefund(order *Order, refund *Refund) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		locked, err := lockOrder(tx, "id = ?", order.ID)
+		if err != nil {
+			return err
+		}
+		*order = *locked
+
+		result := tx.Model(refund).Where("status = ?", RefundStatusPending).Update("status", RefundStatusFailed)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		refund.Status = RefundStatusFailed
+		if err := applyRefundItems(tx, refund, -1); err != nil {
+			return err
+		}
+
+		if err := updateRefundedAmount(tx, order); err != nil {
+			return err
+		}
+		return tx.Model(order).Update("refunded_amount", order.RefundedAmount).Error
+	})
+}
+
+// refundItemsFor validates requested lines against the order, defaulting to
+// every unit not yet refunded, and returns the refund items with their value.
+// A refund of every unit left also returns whatever else is left of the
+// total, such as shipping and rounding, on its last line.
+func refundItemsFor(order *Order, lines []RefundLine) ([]RefundItem, int64, error) {
+	requested := map[uint]int{}
+	if len(lines) == 0 {
+		for _, item := range order.Items {
+			requested[item.ID] = item.RefundableQuantity()
+		}
+	}
+	for _, line := range lines {
+		if line.Quantity < 0 {
+			return nil, 0, fmt.Errorf("%w: quantities must not be negative", ErrInvalidRefund)
+		}
+		requested[line.OrderItemID] += line.Quantity
+	}
+
+	found := map[uint]bool{}
+	var items []RefundItem
+	var amount int64
+	unitsLeft := 0
+	for _, item := range order.Items {
+		found[item.ID] = true
+		quantity := requested[item.ID]
+		unitsLeft += item.RefundableQuantity() - quantity
+		if quantity == 0 {
+			continue
+		}
+		if quantity > item.RefundableQuantity() {
+			return nil, 0, fmt.Errorf("%w: only %d of item %d can be refunded", ErrInvalidRefund, item.RefundableQuantity(), item.ID)
+		}
+
+		// Units are refunded with their share of the line's discount and
+		// tax. Shares are counted from the start of the line, so its last
+		// units take whatever rounding left over.
+		share := func(lineTotal int64) int64 {
+			refunded := int64(item.RefundedQuantity)
+			return lineTotal*(refunded+int64(quantity))/int64(item.Quantity) -
+				lineTotal*refunded/int64(item.Quantity)
+		}
+		lineAmount := item.Price*int64(quantity) - share(item.DiscountAmount) + share(item.TaxAmount)
+		items = append(items, RefundItem{
+			OrderItemID: item.ID,
+			Quantity:    quantity,
+			Amount:      lineAmount,
+		})
+		amount += lineAmount
+	}
+
+	for id := range requested {
+		if !found[id] {
+			return nil, 0, fmt.Errorf("%w: item %d is not part of this order", ErrInvalidRefund, id)
+		}
+	}
+	if len(lines) > 0 && len(items) == 0 {
+		return nil, 0, fmt.Errorf("%w: select at least one item", ErrInvalidRefund)
+	}
+
+	if remainder := order.RefundableAmount() - amount; unitsLeft == 0 && remainder > 0 && len(items) > 0 {
+		items[len(items)-1].Amount += remainder
+		amount += remainder
+	}
+	return items, amount, nil
+}
+
+// applyRefundItems marks the refund's units as refunded on their order lines
+// and restocks them if requested. direction is 1 to apply and -1 to undo,
+// which happens when the processor later rejects the refund.
+func applyRefundItems(tx *gorm.DB, refund *Refund, direction int) error {
+	for _, item := range refund.Items {
+		quantity := item.Quantity * direction
+
+		err := tx.Model(&OrderItem{}).Where("id = ?", item.OrderItemID).
+			UpdateColumn("refunded_quantity", gorm.Expr("refunded_quantity + ?", quantity)).Error
+		if err != nil {
+			return fmt.Errorf("update order item: %w", err)
+		}
+
+		if !refund.Restocked {
+			continue
+		}
+		var orderItem OrderItem
+		if err := tx.Select("product_id", "variant_id").First(&orderItem, item.OrderItemID).Error; err != nil {
+			return fmt.Errorf("load order item: %w", err)
+		}
+		if err := restock(tx, orderItem.ProductID, orderItem.VariantID, quantity); err != nil {
+			return fmt.Errorf("restock product: %w", err)
+		}
+	}
+	return nil
+}
+
+// updateRefundedAmount recomputes the order's refunded total from refunds
+// that are pending or completed
+func updateRefundedAmount(tx *gorm.DB, order *Order) error {
+	var refunded int64
+	err := tx.Model(&Refund{}).
+		Where("order_id = ? AND status NOT IN ?", order.ID, []string{RefundStatusRejected, RefundStatusFailed}).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&refunded).Error
+	if err != nil {
+		return err
+	}
+	order.RefundedAmount = refunded
+	return nil
+}
+
+// refundFailed reports whether a refund status means no money was returned
+func refundFailed(status string) bool {
+	return status == RefundStatusRejected || status == RefundStatusFailed
+}
+
+// refundNote describes a refund in the order's status history
+func refundNote(reason string) string {
+	if reason == "" {
+		return "Refund issued"
+	}
+	return "Refund issued: " + reason
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// newPaidOrder places an order for two keyboards through the fake provider
+// and returns it with its items
+func newPaidOrder(t *testing.T) (*checkoutFixture, *Order) {
+	t.Helper()
+
+	f := newCheckoutFixture(t)
+	placed, err := placeOrder(f.user, f.priced, PostalAddress{Country: "US"}, f.auth)
+	if err != nil {
+		t.Fatalf("placeOrder: %v", err)
+	}
+	order, err := lockOrder(DB, "id = ?", placed.ID)
+	if err != nil {
+		t.Fatalf("load order: %v", err)
+	}
+	return f, order
+}
+
+func TestRefundItemsAddUpToOrderTotal(t *testing.T) {
+	// 3 x $10.00 with $1.00 off and $0.83 tax, 1 x $5.00 with $0.41 tax,
+	// and $5.99 shipping
+	order := &Order{
+		Total: 3000 - 100 + 83 + 500 + 41 + 599,
+		Items: []OrderItem{
+			{ID: 1, Quantity: 3, Price: 1000, DiscountAmount: 100, TaxAmount: 83},
+			{ID: 2, Quantity: 1, Price: 500, TaxAmount: 41},
+		},
+	}
+
+	// Refund one unit at a time, as a customer returning items might
+	want := []int64{1000 - 33 + 27, 1000 - 33 + 28, 1000 - 34 + 28, 500 + 41 + 599}
+	steps := []RefundLine{{1, 1}, {1, 1}, {1, 1}, {2, 1}}
+	for i, line := range steps {
+		items, amount, err := refundItemsFor(order, []RefundLine{line})
+		if err != nil {
+			t.Fatalf("refund %d: %v", i+1, err)
+		}
+		if amount != want[i] {
+			t.Errorf("refund %d = %d, want %d", i+1, amount, want[i])
+		}
+		var itemsTotal int64
+		for _, item := range items {
+			itemsTotal += item.Amount
+		}
+		if itemsTotal != amount {
+			t.Errorf("refund %d items add up to %d, not %d", i+1, itemsTotal, amount)
+		}
+
+		for j := range order.Items {
+			if order.Items[j].ID == line.OrderItemID {
+				order.Items[j].RefundedQuantity += line.Quantity
+			}
+		}
+		order.RefundedAmount += amount
+	}
+
+	if order.RefundedAmount != order.Total {
+		t.Errorf("refunds add up to %d, want the order total %d", order.RefundedAmount, order.Total)
+	}
+}
+
+func TestRefundItemsForPartialRefundLeavesShipping(t *testing.T) {
+	order := &Order{
+		Total: 2000 + 599,
+		Items: []OrderItem{{ID: 1, Quantity: 2, Price: 1000}},
+	}
+
+	tests := []struct {
+		lines []RefundLine
+		want  int64
+	}{
+		{[]RefundLine{{1, 1}}, 1000},
+		{[]RefundLine{{1, 2}}, 2599},
+		{nil, 2599},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.lines), func(t *testing.T) {
+			_, amount, err := refundItemsFor(order, tt.lines)
+			if err != nil {
+				t.Fatalf("refundItemsFor: %v", err)
+			}
+			if amount != tt.want {
+				t.Errorf("amount = %d, want %d", amount, tt.want)
+			}
+		})
+	}
+}
+
+func loadRefund(t *testing.T, id string) Refund {
+	t.Helper()
+
+	var refund Refund
+	if err := DB.First(&refund, "id = ?", id).Error; err != nil {
+		t.Fatalf("load refund: %v", err)
+	}
+	return refund
+}
+
+func TestRefundOrderRecordsProviderRefund(t *testing.T) {
+	f, order := newPaidOrder(t)
+	staff := createTestUser(t)
+
+	req := RefundRequest{Lines: []RefundLine{{OrderItemID: order.Items[0].ID, Quantity: 1}}, Restock: true}
+	refund, err := refundOrder(order.ID, req, staff)
+	if err != nil {
+		t.Fatalf("refundOrder: %v", err)
+	}
+
+	saved := loadRefund(t, refund.ID)
+	if saved.Status != RefundStatusCompleted || saved.ProviderRefundID == nil {
+		t.Errorf("refund is %s with provider ID %v, want %s with an ID", saved.Status, saved.ProviderRefundID, RefundStatusCompleted)
+	}
+	if got := f.payment().refunded; got != refund.Amount {
+		t.Errorf("provider refunded %d, want %d", got, refund.Amount)
+	}
+
+	updated := reloadOrder(t, order.ID)
+	if updated.Status != OrderStatusPartiallyRefunded || updated.RefundedAmount != refund.Amount {
+		t.Errorf("order is %s with %d refunded, want %s with %d",
+			updated.Status, updated.RefundedAmount, OrderStatusPartiallyRefunded, refund.Amount)
+	}
+	if got := f.stock(t); got != 4 {
+		t.Errorf("stock = %d, want 4 after restocking one unit", got)
+	}
+}
+
+func TestRefundOrderGivesLinesBackWhenProviderFails(t *testing.T) {
+	f, order := newPaidOrder(t)
+	staff := createTestUser(t)
+
+	// The provider has no such payment and refuses the refund
+	if err := DB.Model(&Order{}).Where("id = ?", order.ID).Update("payment_id", "fake_pay_unknown").Error; err != nil {
+		t.Fatalf("update payment ID: %v", err)
+	}
+
+	req := RefundRequest{Lines: []RefundLine{{OrderItemID: order.Items[0].ID, Quantity: 1}}, Restock: true}
+	if _, err := refundOrder(order.ID, req, staff); err == nil {
+		t.Fatal("refundOrder succeeded, want an error")
+	}
+
+	var refunds []Refund
+	if err := DB.Where("order_id = ?", order.ID).Find(&refunds).Error; err != nil {
+		t.Fatalf("load refunds: %v", err)
+	}
+	if len(refunds) != 1 || refunds[0].Status != RefundStatusFailed {
+		t.Fatalf("refunds = %+v, want one failed refund", refunds)
+	}
+
+	updated := reloadOrder(t, order.ID)
+	if updated.Status != OrderStatusPaid || updated.RefundedAmount != 0 {
+		t.Errorf("order is %s with %d refunded, want %s with nothing", updated.Status, updated.RefundedAmount, OrderStatusPaid)
+	}
+	var item OrderItem
+	if err := DB.First(&item, order.Items[0].ID).Error; err != nil {
+		t.Fatalf("load order item: %v", err)
+	}
+	if item.RefundedQuantity != 0 {
+		t.Errorf("refunded quantity = %d, want 0", item.RefundedQuantity)
+	}
+	if got := f.stock(t); got != 3 {
+		t.Errorf("stock = %d, want 3 with the restock undone", got)
+	}
+}
+
+func TestRefundWebhookAdoptsSubmittedRefund(t *testing.T) {
+	_, order := newPaidOrder(t)
+	configureSquareWebhooks(t)
+
+	// Recorded and sent to the provider, but the provider's ID not saved yet
+	refund := &Refund{ID: uuid.New().String(), OrderID: order.ID, Amount: 1500, Status: RefundStatusPending}
+	if err := DB.Create(refund).Error; err != nil {
+		t.Fatalf("create refund: %v", err)
+	}
+	if err := DB.Model(&Order{}).Where("id = ?", order.ID).Update("payment_id", testPaymentID).Error; err != nil {
+		t.Fatalf("update payment ID: %v", err)
+	}
+
+	body := squareNotification(t, "refund_updated.json")
+	if got := deliverSquareWebhook(t, body, signSquare(testWebhookKey, body)); got != 200 {
+		t.Fatalf("status = %d, want 200", got)
+	}
+
+	var refunds []Refund
+	if err := DB.Where("order_id = ?", order.ID).Find(&refunds).Error; err != nil {
+		t.Fatalf("load refunds: %v", err)
+	}
+	if len(refunds) != 1 {
+		t.Fatalf("%d refunds recorded, want the submitted one only", len(refunds))
+	}
+	if refunds[0].Status != RefundStatusCompleted || refunds[0].ProviderRefundID == nil {
+		t.Errorf("refund is %s with provider ID %v, want %s with an ID", refunds[0].Status, refunds[0].ProviderRefundID, RefundStatusCompleted)
+	}
+	if updated := reloadOrder(t, order.ID); updated.RefundedAmount != 1500 {
+		t.Errorf("refunded amount = %d, want 1500", updated.RefundedAmount)
+	}
+}
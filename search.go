@@ -0,0 +1,101 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// productSearchVector is the tsvector searched for products. It must match
+// the expression of idx_products_search (see runMigrations) for the GIN
+// index to be used.
+const productSearchVector = "to_tsvector('english', coalesce(products.name, '') || ' ' || coalesce(products.description, ''))"
+
+// searchResultsLimit caps the live-search dropdown
+const searchResultsLimit = 8
+
+// createSearchIndex adds the GIN index backing product search
+func createSearchIndex(db *gorm.DB) error {
+	return db.Exec("CREATE INDEX IF NOT EXISTS idx_products_search ON products USING GIN (" +
+		"to_tsvector('english', coalesce(name, '') || ' ' || coalesce(description, '')))").Error
+}
+
+// prefixTSQuery turns free text into a tsquery string where every word is
+// prefix matched, e.g. "wire head" -> "wire:* & head:*". Punctuation is
+// dropped so user input can never produce tsquery syntax errors.
+func prefixTSQuery(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		terms = append(terms, word+":*")
+	}
+	return strings.Join(terms, " & ")
+}
+
+// applySearch restricts a product query to full-text matches for text
+func applySearch(db *gorm.DB, text string) *gorm.DB {
+	tsquery := prefixTSQuery(text)
+	if tsquery == "" {
+		return db
+	}
+	return db.Where(productSearchVector+" @@ to_tsquery('english', ?)", tsquery)
+}
+
+// orderBySearchRank sorts matches by relevance, best first
+func orderBySearchRank(db *gorm.DB, text string) *gorm.DB {
+	tsquery := prefixTSQuery(text)
+	if tsquery == "" {
+		return db
+	}
+	return db.Order(clause.Expr{
+		SQL:                "ts_rank(" + productSearchVector + ", to_tsquery('english', ?)) DESC, products.id ASC",
+		Vars:               []interface{}{tsquery},
+		WithoutParentheses: true,
+	})
+}
+
+// searchHandler powers the live-search box. HTMX requests get the results
+// partial; regular requests are sent to the filtered home page.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	if r.Header.Get("HX-Request") != "true" {
+		http.Redirect(w, r, "/?q="+url.QueryEscape(query), http.StatusSeeOther)
+		return
+	}
+
+	tmpl := template.New("home.html").Funcs(template.FuncMap{
+		"divf": func(a, b int64) float64 {
+			return float64(a) / float64(b)
+		},
+	})
+
+	tmpl, err := tmpl.ParseFiles("templates/home.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var products []Product
+	if prefixTSQuery(query) != "" {
+		db := applySearch(DB.Where("products.archived_at IS NULL"), query)
+		orderBySearchRank(db, query).Limit(searchResultsLimit).Find(&products)
+	}
+
+	data := map[string]interface{}{
+		"Query":    query,
+		"Products": products,
+	}
+	if err := tmpl.ExecuteTemplate(w, "search-results", data); err != nil {
+		log.Printf("Template execution error: %v", err)
+	}
+}
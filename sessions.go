@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// accessTokenTTL is how long an access token (JWT) is accepted
+	accessTokenTTL = 15 * time.Minute
+
+	// refreshTokenTTL is how long a login lasts without being refreshed
+	refreshTokenTTL = 7 * 24 * time.Hour
+
+	// refreshLeeway is how long a refreshed token may be presented again
+	// before it counts as stolen. Browsers often send several requests at
+	// once with the same expired cookies, and each of them refreshes.
+	refreshLeeway = 30 * time.Second
+
+	refreshCookie = "refresh_token"
+)
+
+var (
+	// ErrSessionRevoked is returned for a validly signed token whose session
+	// has been logged out, revoked, refreshed or has expired
+	ErrSessionRevoked = errors.New("session has been revoked")
+
+	// ErrInvalidRefreshToken is returned for an unknown or expired refresh token
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+	// ErrRefreshTokenReused is returned when an already-used refresh token is
+	// presented again. Every session of that login is revoked.
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// sessionTokens are the credentials handed out for a session
+type sessionTokens struct {
+	AccessToken      string
+	AccessExpiresAt  time.Time
+	RefreshToken     string
+	RefreshExpiresAt time.Time
+}
+
+// ExpiresIn returns the access token's lifetime in seconds
+func (t sessionTokens) ExpiresIn() int {
+	return int(time.Until(t.AccessExpiresAt).Seconds())
+}
+
+// issueSession creates a session in the given family and its tokens
+func issueSession(tx *gorm.DB, user *User, familyID string) (sessionTokens, error) {
+	var tokens sessionTokens
+	var err error
+	if tokens.RefreshToken, err = randomToken(); err != nil {
+		return tokens, err
+	}
+	tokens.RefreshExpiresAt = time.Now().Add(refreshTokenTTL)
+
+	session := &Session{
+		ID:               uuid.New().String(),
+		UserID:           user.ID,
+		FamilyID:         familyID,
+		RefreshTokenHash: hashToken(tokens.RefreshToken),
+		ExpiresAt:        tokens.RefreshExpiresAt,
+	}
+	if err := tx.Create(session).Error; err != nil {
+		return tokens, err
+	}
+
+	tokens.AccessToken, tokens.AccessExpiresAt, err = GenerateJWT(user, session.ID)
+	return tokens, err
+}
+
+// startSession logs the user in with a new session family
+func startSession(user *User) (sessionTokens, error) {
+	return issueSession(DB, user, uuid.New().String())
+}
+
+// rotateSession exchanges a refresh token for new tokens. The old refresh
+// token, and access tokens issued with it, stop working. Presenting it again
+// after refreshLeeway revokes the whole family, since only a thief would
+// still hold it.
+func rotateSession(refreshToken string) (*User, sessionTokens, error) {
+	var user User
+	var tokens sessionTokens
+	reused := false
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var session Session
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("refresh_token_hash = ?", hashToken(refreshToken)).
+			First(&session).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return err
+		}
+
+		if session.RotatedAt != nil && time.Since(*session.RotatedAt) > refreshLeeway {
+			reused = true
+			return revokeFamily(tx, session.FamilyID)
+		}
+		if time.Now().After(session.ExpiresAt) {
+			return ErrInvalidRefreshToken
+		}
+
+		if session.RotatedAt == nil {
+			now := time.Now()
+			if err := tx.Model(&session).Update("rotated_at", &now).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Where("id = ?", session.UserID).First(&user).Error; err != nil {
+			return err
+		}
+		tokens, err = issueSession(tx, &user, session.FamilyID)
+		return err
+	})
+	if reused {
+		log.Printf("Refresh token reused; revoked its sessions")
+		return nil, tokens, ErrRefreshTokenReused
+	}
+	if err != nil {
+		return nil, tokens, err
+	}
+	return &user, tokens, nil
+}
+
+// checkSession verifies the token's session is still live
+func checkSession(claims *Claims) error {
+	if claims.ID == "" {
+		return ErrSessionRevoked
+	}
+
+	var count int64
+	err := DB.Model(&Session{}).
+		Where("id = ? AND user_id = ? AND rotated_at IS NULL AND expires_at > ?", claims.ID, claims.UserID, time.Now()).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrSessionRevoked
+	}
+	return nil
+}
+
+// revokeFamily ends a login: the session and every one refreshed from it
+func revokeFamily(tx *gorm.DB, familyID string) error {
+	return tx.Where("family_id = ?", familyID).Delete(&Session{}).Error
+}
+
+// revokeSessions signs the user out everywhere by deleting all of their
+// sessions
+func revokeSessions(tx *gorm.DB, userID string) error {
+	return tx.Where("user_id = ?", userID).Delete(&Session{}).Error
+}
+
+// endSession revokes the login behind the request's refresh token cookie,
+// or failing that behind its access token, even an expired one
+func endSession(r *http.Request) error {
+	var session Session
+	if cookie, err := r.Cookie(refreshCookie); err == nil {
+		if DB.Where("refresh_token_hash = ?", hashToken(cookie.Value)).First(&session).Error == nil {
+			return revokeFamily(DB, session.FamilyID)
+		}
+	}
+
+	cookie, err := r.Cookie("auth_token")
+	if err != nil {
+		return nil
+	}
+	claims := &Claims{}
+	_, err = jwt.ParseWithClaims(cookie.Value, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(os.Getenv("JWT_SECRET")), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithoutClaimsValidation())
+	if err != nil || claims.ID == "" {
+		return nil
+	}
+	if DB.Where("id = ?", claims.ID).First(&session).Error != nil {
+		return nil
+	}
+	return revokeFamily(DB, session.FamilyID)
+}
+
+// setAuthCookies stores the session's tokens in the browser. The access
+// token lives in auth_token; the refresh token is only read to renew it.
+func setAuthCookies(w http.ResponseWriter, tokens sessionTokens) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "auth_token",
+		Value:    tokens.AccessToken,
+		Expires:  tokens.AccessExpiresAt,
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookie,
+		Value:    tokens.RefreshToken,
+		Expires:  tokens.RefreshExpiresAt,
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+	})
+}
+
+// clearAuthCookies removes the session's tokens from the browser
+func clearAuthCookies(w http.ResponseWriter) {
+	for _, name := range []string{"auth_token", refreshCookie} {
+		http.SetCookie(w, &http.Cookie{
+			Name:    name,
+			Value:   "",
+			Expires: time.Now().Add(-1 * time.Hour),
+			Path:    "/",
+		})
+	}
+}
+
+// refreshSessionMiddleware renews the browser's access token from its
+// refresh token cookie once the access token has expired, before the
+// request reaches any handler. Handlers see the new auth_token as if the
+// browser had sent it. Requests using an Authorization header are left to
+// call /token/refresh themselves.
+func refreshSessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		refresh, err := r.Cookie(refreshCookie)
+		if err != nil || r.Header.Get("Authorization") != "" || r.URL.Path == "/token/refresh" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if access, err := r.Cookie("auth_token"); err == nil {
+			if _, err := ValidateJWT(access.Value); err == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		_, tokens, err := rotateSession(refresh.Value)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidRefreshToken) && !errors.Is(err, ErrRefreshTokenReused) {
+				log.Printf("Failed to refresh session: %v", err)
+			}
+			clearAuthCookies(w)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		setAuthCookies(w, tokens)
+		replaceCookie(r, "auth_token", tokens.AccessToken)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// replaceCookie rewrites the request's Cookie header with name set to value
+func replaceCookie(r *http.Request, name, value string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != name {
+			r.AddCookie(c)
+		}
+	}
+	r.AddCookie(&http.Cookie{Name: name, Value: value})
+}
+
+// tokenRefreshHandler exchanges a refresh token for new tokens:
+//
+//	POST /token/refresh {"refresh_token": "..."}
+//
+// Browsers may send the refresh_token cookie instead of a body, and get new
+// cookies back. Each refresh token works once; replaying a used one signs
+// out every session of that login.
+func tokenRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	fromCookie := false
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+			return
+		}
+	}
+	if req.RefreshToken == "" {
+		if cookie, err := r.Cookie(refreshCookie); err == nil {
+			req.RefreshToken = cookie.Value
+			fromCookie = true
+		}
+	}
+	if req.RefreshToken == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Refresh token is required"})
+		return
+	}
+
+	user, tokens, err := rotateSession(req.RefreshToken)
+	if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReused) {
+		if fromCookie {
+			clearAuthCookies(w)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid refresh token"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to refresh session: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to refresh token"})
+		return
+	}
+
+	if fromCookie {
+		setAuthCookies(w, tokens)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":       true,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"token_type":    "Bearer",
+		"expires_in":    tokens.ExpiresIn(),
+		"user": map[string]string{
+			"id":    user.ID,
+			"email": user.Email,
+			"name":  user.Name,
+			"role":  user.Role,
+		},
+	})
+}
+
+// logoutAllHandler signs the user out of every browser and device,
+// including this one
+func logoutAllHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := getCurrentUser(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := revokeSessions(DB, user.ID); err != nil {
+		log.Printf("Failed to revoke sessions for user %s: %v", user.ID, err)
+		if isAPIRequest(r) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to sign out"})
+			return
+		}
+		http.Error(w, "Failed to sign out", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s signed out of all sessions", user.Email)
+
+	clearAuthCookies(w)
+	if isAPIRequest(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+		return
+	}
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
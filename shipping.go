@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// ErrShippingUnavailable is returned when the chosen method cannot ship the cart
+var ErrShippingUnavailable = errors.New("shipping method is not available for this order")
+
+// ShippingRate is what one shipping method charges for a particular cart
+type ShippingRate struct {
+	MethodID    string `json:"method_id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Cost        int64  `json:"cost_cents"`
+}
+
+// rate prices the method for a cart with the given subtotal and weight. ok
+// is false when the cart is too heavy for the method.
+func (m ShippingMethod) rate(subtotal int64, weightGrams int) (rate ShippingRate, ok bool) {
+	if m.MaxWeightGrams > 0 && weightGrams > m.MaxWeightGrams {
+		return rate, false
+	}
+
+	cost := m.BaseRate
+	switch m.Kind {
+	case ShippingByWeight:
+		// Each started kilogram is charged in full
+		kilograms := int64((weightGrams + 999) / 1000)
+		cost += m.PerKgRate * kilograms
+	case ShippingFreeOver:
+		if subtotal >= m.FreeOver {
+			cost = 0
+		}
+	}
+
+	return ShippingRate{
+		MethodID:    m.ID,
+		Name:        m.Name,
+		Description: m.Description,
+		Cost:        cost,
+	}, true
+}
+
+// cartWeight returns the shipping weight of the cart in grams
+func cartWeight(items []CartItem) int {
+	weight := 0
+	for _, item := range items {
+		weight += item.Product.WeightGrams * item.Quantity
+	}
+	return weight
+}
+
+// shippingRates prices every active method that can ship the cart, in the
+// order they are offered at checkout
+func shippingRates(items []CartItem, subtotal int64) ([]ShippingRate, error) {
+	var methods []ShippingMethod
+	if err := DB.Where("active = ?", true).Order("sort_order, name").Find(&methods).Error; err != nil {
+		return nil, err
+	}
+
+	weight := cartWeight(items)
+	rates := make([]ShippingRate, 0, len(methods))
+	for _, method := range methods {
+		if rate, ok := method.rate(subtotal, weight); ok {
+			rates = append(rates, rate)
+		}
+	}
+	return rates, nil
+}
+
+// selectShippingRate picks the rate with the given method ID, falling back
+// to the first one offered
+func selectShippingRate(rates []ShippingRate, methodID string) (ShippingRate, bool) {
+	for _, rate := range rates {
+		if rate.MethodID == methodID {
+			return rate, true
+		}
+	}
+	if len(rates) > 0 {
+		return rates[0], true
+	}
+	return ShippingRate{}, false
+}
+
+// checkoutTotalsHandler re-renders the checkout totals when the customer
+// picks a different shipping method or address (HTMX)
+func checkoutTotalsHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := getCurrentUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	tmpl := template.New("checkout.html").Funcs(template.FuncMap{
+		"divf": func(a, b int64) float64 {
+			return float64(a) / float64(b)
+		},
+	})
+
+	tmpl, err = tmpl.ParseFiles("templates/checkout.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Template error: %v", err)
+		return
+	}
+
+	var cartItems []CartItem
+	DB.Preload("Product").Preload("Variant").Where("user_id = ?", user.ID).Find(&cartItems)
+
+	// A coupon that stopped applying was already reported on the checkout page
+	priced, err := priceCart(cartItems, pricingOptions{
+		UserID:           user.ID,
+		CouponCode:       r.URL.Query().Get("coupon_code"),
+		ShipTo:           checkoutTaxAddress(r, user.ID),
+		Shipping:         true,
+		ShippingMethodID: r.URL.Query().Get("shipping_method"),
+	})
+	if err != nil {
+		log.Printf("Failed to price cart: %v", err)
+		http.Error(w, "Failed to price order", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "totals-update", priced); err != nil {
+		log.Printf("Template execution error: %v", err)
+	}
+}
+
+// shippingMethodInput is the editable subset of a ShippingMethod
+type shippingMethodInput struct {
+	Name           string `json:"name"`
+	Description    string `json:"description"`
+	Kind           string `json:"kind"`
+	BaseRate       int64  `json:"base_rate_cents"`
+	PerKgRate      int64  `json:"per_kg_cents"`
+	FreeOver       int64  `json:"free_over_cents"`
+	MaxWeightGrams int    `json:"max_weight_grams"`
+	SortOrder      int    `json:"sort_order"`
+	Active         *bool  `json:"active"` // defaults to true
+}
+
+// validate checks the input and normalizes whitespace
+func (in *shippingMethodInput) validate() error {
+	in.Name = strings.TrimSpace(in.Name)
+	in.Description = strings.TrimSpace(in.Description)
+
+	if in.Name == "" {
+		return errors.New("Name is required")
+	}
+	switch in.Kind {
+	case ShippingFlat, ShippingByWeight:
+	case ShippingFreeOver:
+		if in.FreeOver <= 0 {
+			return errors.New("Free shipping threshold must be greater than zero")
+		}
+	default:
+		return errors.New("Kind must be flat, weight or free_over")
+	}
+	if in.BaseRate < 0 || in.PerKgRate < 0 || in.FreeOver < 0 {
+		return errors.New("Rates cannot be negative")
+	}
+	if in.MaxWeightGrams < 0 {
+		return errors.New("Maximum weight cannot be negative")
+	}
+	return nil
+}
+
+// apply copies the input onto a shipping method
+func (in shippingMethodInput) apply(m *ShippingMethod) {
+	m.Name = in.Name
+	m.Description = in.Description
+	m.Kind = in.Kind
+	m.BaseRate = in.BaseRate
+	m.PerKgRate = in.PerKgRate
+	m.FreeOver = in.FreeOver
+	m.MaxWeightGrams = in.MaxWeightGrams
+	m.SortOrder = in.SortOrder
+	m.Active = in.Active == nil || *in.Active
+}
+
+// adminShippingMethodsAPIHandler manages shipping methods as JSON:
+//
+//	GET    /api/admin/shipping-methods         list every method
+//	POST   /api/admin/shipping-methods         add a method
+//	PUT    /api/admin/shipping-methods?id=X    replace a method
+//	DELETE /api/admin/shipping-methods?id=X    stop offering a method
+func adminShippingMethodsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	methodID := r.URL.Query().Get("id")
+
+	var method ShippingMethod
+	if methodID != "" {
+		if err := DB.Where("id = ?", methodID).First(&method).Error; err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Shipping method not found"})
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if methodID != "" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"shipping_method": method})
+			return
+		}
+
+		var methods []ShippingMethod
+		DB.Order("sort_order, name").Find(&methods)
+		json.NewEncoder(w).Encode(map[string]interface{}{"shipping_methods": methods})
+
+	case http.MethodPost, http.MethodPut:
+		if r.Method == http.MethodPut && methodID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Shipping method id is required"})
+			return
+		}
+
+		var in shippingMethodInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+			return
+		}
+		if err := in.validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		in.apply(&method)
+
+		var err error
+		status := http.StatusOK
+		if r.Method == http.MethodPost {
+			method.ID = uuid.New().String()
+			status = http.StatusCreated
+			err = DB.Create(&method).Error
+		} else {
+			err = DB.Save(&method).Error
+		}
+		if err != nil {
+			log.Printf("Failed to save shipping method: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save shipping method"})
+			return
+		}
+
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "shipping_method": method})
+
+	case http.MethodDelete:
+		if methodID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Shipping method id is required"})
+			return
+		}
+		// Past orders keep the method's name, so methods are deactivated
+		// rather than deleted
+		if err := DB.Model(&method).Update("active", false).Error; err != nil {
+			log.Printf("Failed to deactivate shipping method: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to deactivate shipping method"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "shipping_method": method})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// taxCategories lists the valid product tax categories
+var taxCategories = []string{TaxStandard, TaxReduced, TaxExempt}
+
+// validTaxCategory reports whether category is one of taxCategories
+func validTaxCategory(category string) bool {
+	for _, c := range taxCategories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// Percent formats the rate for display, e.g. "7.25%"
+func (t TaxRate) Percent() string {
+	percent := strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.3f", float64(t.Rate)/1000), "0"), ".")
+	return percent + "%"
+}
+
+// apply returns the tax on amount cents, rounded half up to the cent
+func (t TaxRate) apply(amount int64) int64 {
+	return (amount*int64(t.Rate) + 50000) / 100000
+}
+
+// TaxLine is the total collected for one tax rate, for display
+type TaxLine struct {
+	Name    string `json:"name"`
+	Percent string `json:"rate"`
+	Amount  int64  `json:"amount_cents"`
+}
+
+// TaxResult is the tax owed on a cart
+type TaxResult struct {
+	Lines       []TaxLine // one per rate that applied
+	ItemAmounts []int64   // tax on each cart line, in cart order
+	Total       int64
+}
+
+// taxRatesFor loads the rates charged in a country and region
+func taxRatesFor(country, region string) ([]TaxRate, error) {
+	var rates []TaxRate
+	err := DB.Where("country = ? AND (region = '' OR region = ?)", country, region).
+		Order("region, name").
+		Find(&rates).Error
+	return rates, err
+}
+
+// calculateTax works out the tax on a cart shipped to shipTo. Each line is
+// taxed by the rates for its product's tax category, after any discount in
+// discounts (one per line, or nil); shipping is not taxed. Without a
+// country there is nothing to look up and the tax is zero.
+func calculateTax(items []CartItem, discounts []int64, shipTo PostalAddress) (TaxResult, error) {
+	result := TaxResult{ItemAmounts: make([]int64, len(items))}
+	if shipTo.Country == "" {
+		return result, nil
+	}
+
+	rates, err := taxRatesFor(shipTo.Country, shipTo.Region)
+	if err != nil {
+		return result, err
+	}
+
+	collected := make([]int64, len(rates))
+	for i, item := range items {
+		category := item.Product.TaxCategory
+		if category == "" {
+			category = TaxStandard
+		}
+
+		amount := item.LineAmount()
+		if discounts != nil {
+			amount -= discounts[i]
+		}
+		for j, rate := range rates {
+			if rate.Category != category {
+				continue
+			}
+			tax := rate.apply(amount)
+			result.ItemAmounts[i] += tax
+			collected[j] += tax
+		}
+	}
+
+	for j, rate := range rates {
+		if collected[j] == 0 {
+			continue
+		}
+		result.Lines = append(result.Lines, TaxLine{Name: rate.Name, Percent: rate.Percent(), Amount: collected[j]})
+		result.Total += collected[j]
+	}
+	return result, nil
+}
+
+// checkoutTaxAddress reads where the checkout form says the order is going:
+// a saved address, or the country and region of a new one
+func checkoutTaxAddress(r *http.Request, userID string) PostalAddress {
+	addressID := r.FormValue("address_id")
+	if addressID != "" && addressID != "new" {
+		if address, err := findAddress(userID, addressID); err == nil {
+			return address.PostalAddress
+		}
+		return PostalAddress{}
+	}
+	return PostalAddress{
+		Country: strings.ToUpper(strings.TrimSpace(r.FormValue("ship_country"))),
+		Region:  strings.ToUpper(strings.TrimSpace(r.FormValue("ship_region"))),
+	}
+}
+
+// taxRateInput is the editable subset of a TaxRate
+type taxRateInput struct {
+	Name     string `json:"name"`
+	Country  string `json:"country"`
+	Region   string `json:"region"`
+	Category string `json:"category"`
+	Rate     int    `json:"rate"`
+}
+
+// validate checks the input and normalizes codes
+func (in *taxRateInput) validate() error {
+	in.Name = strings.TrimSpace(in.Name)
+	in.Country = strings.ToUpper(strings.TrimSpace(in.Country))
+	in.Region = strings.ToUpper(strings.TrimSpace(in.Region))
+	if in.Category == "" {
+		in.Category = TaxStandard
+	}
+
+	if in.Name == "" {
+		return errors.New("Name is required")
+	}
+	if _, ok := countryRules[in.Country]; !ok {
+		return errors.New("Country must be one we ship to")
+	}
+	if in.Category == TaxExempt || !validTaxCategory(in.Category) {
+		return errors.New("Category must be standard or reduced")
+	}
+	if in.Rate <= 0 || in.Rate > 100000 {
+		return errors.New("Rate must be between 0 and 100% (in thousandths of a percent)")
+	}
+	return nil
+}
+
+// adminTaxRatesAPIHandler manages the tax rate table as JSON:
+//
+//	GET    /api/admin/tax-rates?country=US    list rates, optionally for one country
+//	POST   /api/admin/tax-rates               add a rate
+//	PUT    /api/admin/tax-rates?id=X          replace a rate
+//	DELETE /api/admin/tax-rates?id=X          remove a rate
+//
+// Orders keep the tax they were charged, so changing rates never alters
+// past orders.
+func adminTaxRatesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	rateID := r.URL.Query().Get("id")
+
+	var rate TaxRate
+	if rateID != "" {
+		if err := DB.Where("id = ?", rateID).First(&rate).Error; err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Tax rate not found"})
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var rates []TaxRate
+		query := DB.Order("country, region, category, name")
+		if country := r.URL.Query().Get("country"); country != "" {
+			query = query.Where("country = ?", strings.ToUpper(country))
+		}
+		query.Find(&rates)
+		json.NewEncoder(w).Encode(map[string]interface{}{"tax_rates": rates})
+
+	case http.MethodPost, http.MethodPut:
+		if r.Method == http.MethodPut && rateID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Tax rate id is required"})
+			return
+		}
+
+		var in taxRateInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+			return
+		}
+		if err := in.validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		rate.Name = in.Name
+		rate.Country = in.Country
+		rate.Region = in.Region
+		rate.Category = in.Category
+		rate.Rate = in.Rate
+
+		status := http.StatusOK
+		if r.Method == http.MethodPost {
+			status = http.StatusCreated
+		}
+		if err := DB.Save(&rate).Error; err != nil {
+			log.Printf("Failed to save tax rate: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save tax rate"})
+			return
+		}
+
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "tax_rate": rate})
+
+	case http.MethodDelete:
+		if rateID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Tax rate id is required"})
+			return
+		}
+		if err := DB.Delete(&rate).Error; err != nil {
+			log.Printf("Failed to delete tax rate: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to delete tax rate"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+	}
+}
@@ -0,0 +1,656 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// totpPeriod is how long each authenticator code lasts (RFC 6238)
+	totpPeriod = 30 * time.Second
+
+	// totpSkew is how many periods either side of now are accepted, to
+	// allow for clock drift on the user's phone
+	totpSkew = 1
+
+	// totpIssuer names the account in authenticator apps
+	totpIssuer = "TechStore"
+
+	// recoveryCodeCount is how many recovery codes are generated at a time
+	recoveryCodeCount = 10
+
+	// twoFactorLoginTTL is how long a user has to enter their code after
+	// their password
+	twoFactorLoginTTL = 5 * time.Minute
+
+	// twoFactorLoginAttempts is how many wrong codes end a sign in
+	twoFactorLoginAttempts = 5
+
+	// twoFactorLockout is the window wrong codes are counted over; after
+	// twoFactorLockoutAttempts of them the account can't start a sign in,
+	// turn 2FA off or replace its recovery codes until it passes, so codes
+	// can't be guessed one attempt at a time
+	twoFactorLockout         = 15 * time.Minute
+	twoFactorLockoutAttempts = 10
+)
+
+// ErrInvalidTwoFactorCode is returned for a wrong, expired or reused
+// authenticator or recovery code
+var ErrInvalidTwoFactorCode = errors.New("invalid two-factor code")
+
+const (
+	invalidTwoFactorCodeMessage = "That code is not valid. Please try again."
+	twoFactorLockedOutMessage   = "Too many incorrect codes. Please wait 15 minutes and try again."
+
+	// twoFactorRequiredMessage is shown when requireRole turns away a staff
+	// member who has not set up 2FA yet
+	twoFactorRequiredMessage = "Staff accounts must turn on two-factor authentication. Set it up from your profile."
+)
+
+// totpEncoding is the base32 alphabet authenticator apps expect, unpadded
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// staffTwoFactorRequired reports whether staff must use two-factor
+// authentication, from STAFF_2FA ("required", the default, or "optional")
+func staffTwoFactorRequired() bool {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv("STAFF_2FA")))
+	switch value {
+	case "", "required":
+		return true
+	case "optional":
+		return false
+	default:
+		log.Printf("Invalid STAFF_2FA %q, using required", value)
+		return true
+	}
+}
+
+// TwoFactorRequired reports whether the user's role obliges them to use
+// two-factor authentication
+func (u *User) TwoFactorRequired() bool {
+	return u.IsStaff() && staffTwoFactorRequired()
+}
+
+// NeedsTwoFactorSetup reports whether the user must turn on two-factor
+// authentication before using their privileges
+func (u *User) NeedsTwoFactorSetup() bool {
+	return u.TwoFactorRequired() && !u.TOTPEnabled
+}
+
+// newTOTPSecret returns a random 160-bit authenticator key, base32 encoded
+func newTOTPSecret() (string, error) {
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(key), nil
+}
+
+// totpURI is the otpauth:// link authenticator apps scan from a QR code
+func totpURI(secret, email string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", "6")
+	query.Set("period", fmt.Sprint(int(totpPeriod.Seconds())))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+email) + "?" + query.Encode()
+}
+
+// totpCode computes the six-digit code for a time step (RFC 4226 HOTP)
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000), nil
+}
+
+// matchTOTP returns the time step a code is valid for at now, if it is
+// newer than lastStep
+func matchTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if secret == "" || len(code) != 6 {
+		return 0, false
+	}
+
+	current := now.Unix() / int64(totpPeriod.Seconds())
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// normalizeRecoveryCode strips the formatting users may type or paste
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// newRecoveryCodes replaces the user's recovery codes and returns the new
+// ones, formatted like "abcde-fghij", to show the user once
+func newRecoveryCodes(tx *gorm.DB, userID string) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for len(codes) < recoveryCodeCount {
+		secret := make([]byte, 8)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(secret))[:10]
+
+		err := tx.Create(&RecoveryCode{
+			ID:       uuid.New().String(),
+			UserID:   userID,
+			CodeHash: hashToken(code),
+		}).Error
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+	return codes, nil
+}
+
+// turnOffTwoFactor forgets the user's authenticator key and recovery codes
+func turnOffTwoFactor(tx *gorm.DB, user *User) error {
+	err := tx.Model(user).Updates(map[string]interface{}{
+		"totp_enabled":   false,
+		"totp_secret":    "",
+		"totp_last_step": 0,
+	}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Where("user_id = ?", user.ID).Delete(&RecoveryCode{}).Error
+}
+
+// recoveryCodesLeft counts the user's unused recovery codes
+func recoveryCodesLeft(userID string) int64 {
+	var count int64
+	DB.Model(&RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count)
+	return count
+}
+
+// verifySecondFactor accepts a current authenticator code or an unused
+// recovery code for the user, and uses it up so it can't be replayed
+func verifySecondFactor(tx *gorm.DB, user *User, code string) error {
+	if step, ok := matchTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep); ok {
+		// Conditional so two requests racing with one code can't both pass
+		result := tx.Model(&User{}).
+			Where("id = ? AND totp_last_step < ?", user.ID, step).
+			Update("totp_last_step", step)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidTwoFactorCode
+		}
+		user.TOTPLastStep = step
+		return nil
+	}
+
+	normalized := normalizeRecoveryCode(code)
+	if normalized == "" {
+		return ErrInvalidTwoFactorCode
+	}
+	result := tx.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, hashToken(normalized)).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidTwoFactorCode
+	}
+	log.Printf("User %s used a recovery code", user.Email)
+	return nil
+}
+
+// twoFactorLockedOut reports whether too many wrong codes were entered for
+// the user recently to accept another one
+func twoFactorLockedOut(userID string) (bool, error) {
+	var misses int64
+	err := DB.Model(&AccountToken{}).
+		Select("COALESCE(SUM(attempts), 0)").
+		Where("user_id = ? AND purpose = ? AND created_at > ?", userID, TokenTwoFactor, time.Now().Add(-twoFactorLockout)).
+		Scan(&misses).Error
+	return misses >= twoFactorLockoutAttempts, err
+}
+
+// recordTwoFactorMiss counts a wrong code entered by a signed-in user
+// toward the same lockout as sign in attempts. It is stored as a spent
+// challenge, so it can never be redeemed.
+func recordTwoFactorMiss(userID string) error {
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return DB.Create(&AccountToken{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Purpose:   TokenTwoFactor,
+		TokenHash: hashToken(token),
+		ExpiresAt: now,
+		UsedAt:    &now,
+		Attempts:  1,
+	}).Error
+}
+
+// checkTwoFactorCode verifies a signed-in user's code before change runs
+// in the same transaction, refusing with a 429 once they are locked out
+// and counting a wrong code. It writes the error response and returns
+// false unless change succeeded; failed names the action for a 500.
+func checkTwoFactorCode(w http.ResponseWriter, user *User, code, failed string, change func(tx *gorm.DB) error) bool {
+	locked, err := twoFactorLockedOut(user.ID)
+	if err != nil {
+		log.Printf("Failed to check two-factor lockout: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": failed})
+		return false
+	}
+	if locked {
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]string{"error": twoFactorLockedOutMessage})
+		return false
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := verifySecondFactor(tx, user, code); err != nil {
+			return err
+		}
+		return change(tx)
+	})
+	if errors.Is(err, ErrInvalidTwoFactorCode) {
+		if err := recordTwoFactorMiss(user.ID); err != nil {
+			log.Printf("Failed to record wrong two-factor code: %v", err)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": invalidTwoFactorCodeMessage})
+		return false
+	}
+	if err != nil {
+		log.Printf("%s: %v", failed, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": failed})
+		return false
+	}
+	return true
+}
+
+// startTwoFactorLogin is the first half of signing in with 2FA: after the
+// password checks out it hands back a short-lived challenge instead of a
+// session, to be completed at /login/2fa
+func startTwoFactorLogin(w http.ResponseWriter, user *User) {
+	w.Header().Set("Content-Type", "application/json")
+
+	locked, err := twoFactorLockedOut(user.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to sign in"})
+		return
+	}
+	if locked {
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]string{"error": twoFactorLockedOutMessage})
+		return
+	}
+
+	challenge, err := issueAccountToken(DB, user.ID, TokenTwoFactor, twoFactorLoginTTL)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to sign in"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":             false,
+		"two_factor_required": true,
+		"challenge":           challenge,
+	})
+}
+
+// loginTwoFactorHandler completes a sign in with the challenge from
+// loginHandler and an authenticator or recovery code
+//
+//	POST /login/2fa {"challenge": "...", "code": "123456"}
+func loginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	var req struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		return
+	}
+
+	var user User
+	var wrongCode, exhausted bool
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		challenge, err := findAccountToken(tx.Clauses(clause.Locking{Strength: "UPDATE"}), req.Challenge, TokenTwoFactor)
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("id = ?", challenge.UserID).First(&user).Error; err != nil {
+			return err
+		}
+
+		err = verifySecondFactor(tx, &user, req.Code)
+		if errors.Is(err, ErrInvalidTwoFactorCode) {
+			// Count the miss, committed so it sticks, and end the sign in
+			// after too many
+			wrongCode = true
+			updates := map[string]interface{}{"attempts": gorm.Expr("attempts + 1")}
+			if challenge.Attempts+1 >= twoFactorLoginAttempts {
+				exhausted = true
+				updates["used_at"] = time.Now()
+			}
+			return tx.Model(challenge).Updates(updates).Error
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Model(challenge).Update("used_at", time.Now()).Error
+	})
+
+	switch {
+	case errors.Is(err, ErrInvalidAccountToken) || exhausted:
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   "This sign in has expired. Please enter your password again.",
+			"restart": true,
+		})
+		return
+	case err != nil:
+		log.Printf("Failed to verify two-factor code: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to sign in"})
+		return
+	case wrongCode:
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": invalidTwoFactorCodeMessage})
+		return
+	}
+
+	completeLogin(w, r, &user)
+}
+
+// twoFactorSetupHandler starts enrollment: it gives the user a new
+// authenticator key, which takes effect once confirmed with a code at
+// /2fa/enable
+//
+//	POST /2fa/setup
+func twoFactorSetupHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	user, err := getCurrentUser(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+		return
+	}
+	if user.TOTPEnabled {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Two-factor authentication is already on"})
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err == nil {
+		err = DB.Model(user).Update("totp_secret", secret).Error
+	}
+	if err != nil {
+		log.Printf("Failed to start two-factor setup: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to start two-factor setup"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"secret":  secret,
+		"uri":     totpURI(secret, user.Email),
+	})
+}
+
+// decodeTwoFactorCode reads {"code": "..."} from a request body, writing
+// the error response if it can't
+func decodeTwoFactorCode(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Code) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Please enter a code"})
+		return "", false
+	}
+	return req.Code, true
+}
+
+// twoFactorEnableHandler finishes enrollment once the user proves their
+// app works, and returns their recovery codes. Every other session is
+// signed out, since it was signed in with the password alone.
+//
+//	POST /2fa/enable {"code": "123456"}
+func twoFactorEnableHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	user, err := getCurrentUser(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+		return
+	}
+	code, ok := decodeTwoFactorCode(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabled {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Two-factor authentication is already on"})
+		return
+	}
+	if user.TOTPSecret == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Start two-factor setup first"})
+		return
+	}
+
+	step, ok := matchTOTP(user.TOTPSecret, code, time.Now(), 0)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": invalidTwoFactorCodeMessage})
+		return
+	}
+
+	var codes []string
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(user).Updates(map[string]interface{}{
+			"totp_enabled":   true,
+			"totp_last_step": step,
+		}).Error
+		if err != nil {
+			return err
+		}
+		if codes, err = newRecoveryCodes(tx, user.ID); err != nil {
+			return err
+		}
+		return revokeSessions(tx, user.ID)
+	})
+	if err != nil {
+		log.Printf("Failed to enable two-factor authentication: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to turn on two-factor authentication"})
+		return
+	}
+	log.Printf("User %s turned on two-factor authentication", user.Email)
+
+	// Keep this browser signed in with a fresh session
+	tokens, err := startSession(user)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to generate token"})
+		return
+	}
+	setAuthCookies(w, tokens)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"message":        "Two-factor authentication is on",
+		"recovery_codes": codes,
+		"token":          tokens.AccessToken,
+		"refresh_token":  tokens.RefreshToken,
+		"expires_in":     tokens.ExpiresIn(),
+	})
+}
+
+// twoFactorDisableHandler turns two-factor authentication off, given a
+// current code. Staff can't while their role requires it.
+//
+//	POST /2fa/disable {"code": "123456"}
+func twoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	user, err := getCurrentUser(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+		return
+	}
+	code, ok := decodeTwoFactorCode(w, r)
+	if !ok {
+		return
+	}
+	if !user.TOTPEnabled {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Two-factor authentication is already off"})
+		return
+	}
+	if user.TwoFactorRequired() {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Staff accounts must keep two-factor authentication on"})
+		return
+	}
+
+	turnOff := func(tx *gorm.DB) error { return turnOffTwoFactor(tx, user) }
+	if !checkTwoFactorCode(w, user, code, "Failed to turn off two-factor authentication", turnOff) {
+		return
+	}
+	log.Printf("User %s turned off two-factor authentication", user.Email)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Two-factor authentication is off",
+	})
+}
+
+// recoveryCodesHandler replaces the user's recovery codes, given a current
+// code, and returns the new ones
+//
+//	POST /2fa/recovery-codes {"code": "123456"}
+func recoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	user, err := getCurrentUser(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+		return
+	}
+	code, ok := decodeTwoFactorCode(w, r)
+	if !ok {
+		return
+	}
+	if !user.TOTPEnabled {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Two-factor authentication is off"})
+		return
+	}
+
+	var codes []string
+	replace := func(tx *gorm.DB) error {
+		var err error
+		codes, err = newRecoveryCodes(tx, user.ID)
+		return err
+	}
+	if !checkTwoFactorCode(w, user, code, "Failed to generate recovery codes", replace) {
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"recovery_codes": codes,
+	})
+}
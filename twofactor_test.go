@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestCheckTwoFactorCodeLocksOutAfterWrongCodes(t *testing.T) {
+	useTestDatabase(t)
+	user := createTestUser(t)
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatalf("newTOTPSecret: %v", err)
+	}
+	user.TOTPSecret = secret
+	user.TOTPEnabled = true
+
+	changed := false
+	change := func(tx *gorm.DB) error {
+		changed = true
+		return nil
+	}
+	check := func() int {
+		w := httptest.NewRecorder()
+		checkTwoFactorCode(w, user, "not-a-code", "Failed", change)
+		return w.Code
+	}
+
+	for i := 1; i <= twoFactorLockoutAttempts; i++ {
+		if got := check(); got != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d: status = %d, want %d", i, got, http.StatusUnauthorized)
+		}
+	}
+	if got := check(); got != http.StatusTooManyRequests {
+		t.Errorf("status after %d wrong codes = %d, want %d", twoFactorLockoutAttempts, got, http.StatusTooManyRequests)
+	}
+	if changed {
+		t.Error("change ran without a valid code")
+	}
+
+	// The misses count toward signing in too
+	if locked, err := twoFactorLockedOut(user.ID); err != nil || !locked {
+		t.Errorf("twoFactorLockedOut = %v, %v; want locked", locked, err)
+	}
+}
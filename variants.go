@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// liveVariants preloads the variants still on sale, in display order. Use
+// it with Preload("Variants", liveVariants).
+func liveVariants(db *gorm.DB) *gorm.DB {
+	return db.Where("archived_at IS NULL").Order("sort_order, sku")
+}
+
+// variant finds one of the product's loaded variants by ID
+func (p Product) variant(id string) (*ProductVariant, bool) {
+	for i := range p.Variants {
+		if p.Variants[i].ID == id {
+			return &p.Variants[i], true
+		}
+	}
+	return nil, false
+}
+
+// sameOptions reports whether two variants would be described the same way
+func sameOptions(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || !strings.EqualFold(other, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// variantInput is the editable subset of a ProductVariant
+type variantInput struct {
+	SKU       string            `json:"sku"`
+	Options   map[string]string `json:"options"`
+	Price     *int64            `json:"price_cents"` // null to use the product price
+	Stock     int               `json:"stock"`
+	StockSeen *int              `json:"stock_seen"` // stock the editor started from, if known
+	SortOrder int               `json:"sort_order"`
+	Archived  bool              `json:"archived"`
+}
+
+// validate checks the input and normalizes the SKU and option names
+func (in *variantInput) validate() error {
+	in.SKU = strings.ToUpper(strings.TrimSpace(in.SKU))
+
+	options := make(map[string]string, len(in.Options))
+	for key, value := range in.Options {
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if key == "" || value == "" {
+			return errors.New("Options need a name and a value")
+		}
+		options[key] = value
+	}
+	in.Options = options
+
+	if in.SKU == "" {
+		return errors.New("SKU is required")
+	}
+	if len(in.Options) == 0 {
+		return errors.New("At least one option, such as size or color, is required")
+	}
+	if in.Price != nil && *in.Price <= 0 {
+		return errors.New("Price must be greater than zero")
+	}
+	if in.Stock < 0 {
+		return errors.New("Stock cannot be negative")
+	}
+	return nil
+}
+
+// apply copies the input onto a variant
+func (in variantInput) apply(v *ProductVariant) {
+	v.SKU = in.SKU
+	v.Options = in.Options
+	v.Price = in.Price
+	v.Stock = in.Stock
+	v.SortOrder = in.SortOrder
+	if !in.Archived {
+		v.ArchivedAt = nil
+	} else if v.ArchivedAt == nil {
+		now := time.Now()
+		v.ArchivedAt = &now
+	}
+}
+
+// stockChange returns how far the input moves a variant's stock, measured
+// from the stock the editor started from (or loaded, without StockSeen),
+// as productInput.stockChange does for products
+func (in variantInput) stockChange(loaded int) int {
+	seen := loaded
+	if in.StockSeen != nil {
+		seen = *in.StockSeen
+	}
+	return in.Stock - seen
+}
+
+// updateVariant saves a variant's edits, leaving the stored stock alone
+// apart from adding stockChange so concurrent checkouts are not overwritten
+func updateVariant(variant *ProductVariant, stockChange int) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Stock").Save(variant).Error; err != nil {
+			return err
+		}
+		if stockChange != 0 {
+			if err := restock(tx, variant.ProductID, &variant.ID, stockChange); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&ProductVariant{}).Where("id = ?", variant.ID).Pluck("stock", &variant.Stock).Error
+	})
+}
+
+// archiveVariant stops selling a variant and removes it from every cart.
+// Orders keep pointing at it, so it is never deleted.
+func archiveVariant(variant *ProductVariant) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Model(variant).Update("archived_at", &now).Error; err != nil {
+			return err
+		}
+		return tx.Where("variant_id = ?", variant.ID).Delete(&CartItem{}).Error
+	})
+}
+
+// adminVariantsAPIHandler manages a product's variants as JSON:
+//
+//	GET    /api/admin/products/variants?product_id=X    list the product's variants
+//	POST   /api/admin/products/variants?product_id=X    add a variant
+//	PUT    /api/admin/products/variants?id=X            replace a variant
+//	DELETE /api/admin/products/variants?id=X            archive a variant
+//
+// Once a product has variants, their stock is what is sold and the
+// product's own stock is ignored.
+func adminVariantsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	variantID := r.URL.Query().Get("id")
+	productID := r.URL.Query().Get("product_id")
+
+	// Creating never targets an existing variant; updates go through PUT
+	if r.Method == http.MethodPost && variantID != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Variant id is not allowed when creating; use PUT to update"})
+		return
+	}
+
+	var variant ProductVariant
+	if variantID != "" {
+		if err := DB.Where("id = ?", variantID).First(&variant).Error; err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Variant not found"})
+			return
+		}
+		productID = variant.ProductID
+	}
+
+	var product Product
+	if productID == "" || DB.Where("id = ?", productID).First(&product).Error != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if variantID != "" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"variant": variant})
+			return
+		}
+
+		var variants []ProductVariant
+		DB.Where("product_id = ?", product.ID).Order("archived_at IS NOT NULL, sort_order, sku").Find(&variants)
+		json.NewEncoder(w).Encode(map[string]interface{}{"product_id": product.ID, "variants": variants})
+
+	case http.MethodPost, http.MethodPut:
+		if r.Method == http.MethodPut && variantID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Variant id is required"})
+			return
+		}
+
+		var in variantInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+			return
+		}
+		if err := in.validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+
+		var taken int64
+		if err := DB.Model(&ProductVariant{}).Where("sku = ? AND id <> ?", in.SKU, variant.ID).Count(&taken).Error; err != nil {
+			log.Printf("Failed to check variant SKU: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save variant"})
+			return
+		}
+		if taken > 0 {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "A variant with that SKU already exists"})
+			return
+		}
+
+		if !in.Archived {
+			var siblings []ProductVariant
+			if err := DB.Scopes(liveVariants).Where("product_id = ? AND id <> ?", product.ID, variant.ID).Find(&siblings).Error; err != nil {
+				log.Printf("Failed to load variants: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save variant"})
+				return
+			}
+			for _, sibling := range siblings {
+				if sameOptions(sibling.Options, in.Options) {
+					w.WriteHeader(http.StatusConflict)
+					json.NewEncoder(w).Encode(map[string]string{"error": "The product already has a variant with those options"})
+					return
+				}
+			}
+		}
+
+		wasArchived := variant.ArchivedAt != nil
+		stockChange := in.stockChange(variant.Stock)
+		in.apply(&variant)
+		create := r.Method == http.MethodPost
+
+		var err error
+		if create {
+			variant.ProductID = product.ID
+			err = DB.Create(&variant).Error
+		} else {
+			err = updateVariant(&variant, stockChange)
+		}
+		switch {
+		case err != nil:
+		case create:
+			// Lines added before the product had variants cannot be fulfilled
+			err = DB.Where("product_id = ? AND variant_id IS NULL", product.ID).Delete(&CartItem{}).Error
+		case variant.ArchivedAt != nil && !wasArchived:
+			err = DB.Where("variant_id = ?", variant.ID).Delete(&CartItem{}).Error
+		}
+		if err != nil {
+			log.Printf("Failed to save variant: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save variant"})
+			return
+		}
+
+		if create {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "variant": variant})
+
+	case http.MethodDelete:
+		if variantID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Variant id is required"})
+			return
+		}
+		if err := archiveVariant(&variant); err != nil {
+			log.Printf("Failed to archive variant: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to archive variant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "variant": variant})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// emailVerificationTTL is how long a verification link works
+	emailVerificationTTL = 48 * time.Hour
+
+	// verificationResendInterval is the least time between verification
+	// emails to one account
+	verificationResendInterval = time.Minute
+)
+
+// ErrEmailNotVerified is returned when checkout requires a verified email
+var ErrEmailNotVerified = errors.New("email not verified")
+
+const (
+	emailNotVerifiedMessage = "Please verify your email address before checking out. We've sent a link to your inbox; you can resend it from your profile."
+
+	// verificationRecentlySentMessage names verificationResendInterval;
+	// keep the two in step
+	verificationRecentlySentMessage = "A link was sent recently. Please check your inbox or try again in a minute."
+)
+
+// errVerificationRecentlySent is returned instead of sending another
+// verification email within verificationResendInterval of the last one
+var errVerificationRecentlySent = errors.New("verification email recently sent")
+
+// emailVerificationRequired reports whether customers must verify their
+// email before checking out, from EMAIL_VERIFICATION ("required", or
+// "optional", the default)
+func emailVerificationRequired() bool {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv("EMAIL_VERIFICATION")))
+	switch value {
+	case "required":
+		return true
+	case "", "optional":
+		return false
+	default:
+		log.Printf("Invalid EMAIL_VERIFICATION %q, using optional", value)
+		return false
+	}
+}
+
+// checkCanCheckout applies the email verification policy to a user
+func checkCanCheckout(user *User) error {
+	if emailVerificationRequired() && !user.EmailVerified {
+		return ErrEmailNotVerified
+	}
+	return nil
+}
+
+// sendVerificationEmail emails the user a new link to verify their address.
+// It returns errVerificationRecentlySent without sending if one was sent
+// within verificationResendInterval.
+func sendVerificationEmail(user *User) error {
+	recent, err := recentAccountToken(user.ID, TokenVerifyEmail, verificationResendInterval)
+	if err != nil {
+		return err
+	}
+	if recent {
+		return errVerificationRecentlySent
+	}
+
+	token, err := issueAccountToken(DB, user.ID, TokenVerifyEmail, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "Hi %s,\n\n", user.Name)
+	body.WriteString("Please confirm this is your email address by opening this link within 48 hours:\n\n")
+	fmt.Fprintf(&body, "%s\n\n", emailLink("/verify?token="+url.QueryEscape(token)))
+	body.WriteString("If you didn't create a TechStore account, you can ignore this email.\n")
+
+	sendEmail(EmailMessage{
+		To:      user.Email,
+		Subject: "Verify your TechStore email address",
+		Body:    body.String(),
+	})
+	return nil
+}
+
+// verifyEmailHandler marks the address verified when the user follows the
+// link from their verification email
+func verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var user User
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		token, err := redeemAccountToken(tx, r.URL.Query().Get("token"), TokenVerifyEmail)
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("id = ?", token.UserID).First(&user).Error; err != nil {
+			return err
+		}
+		return tx.Model(&user).Update("email_verified", true).Error
+	})
+
+	data := map[string]interface{}{"Verified": err == nil}
+	switch {
+	case errors.Is(err, ErrInvalidAccountToken):
+		data["Error"] = invalidLinkMessage
+	case err != nil:
+		log.Printf("Failed to verify email: %v", err)
+		data["Error"] = "We couldn't verify your email right now. Please try again."
+	default:
+		log.Printf("User %s verified their email", user.Email)
+		data["Email"] = user.Email
+	}
+	if current, err := getCurrentUser(r); err == nil {
+		data["User"] = current
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/verify-email.html"))
+	tmpl.Execute(w, data)
+}
+
+// resendVerificationHandler emails the signed-in user a new verification link
+func resendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	user, err := getCurrentUser(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+		return
+	}
+	if user.EmailVerified {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"message": "Your email address is already verified.",
+		})
+		return
+	}
+
+	err = sendVerificationEmail(user)
+	if errors.Is(err, errVerificationRecentlySent) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": verificationRecentlySentMessage,
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to send verification email to %s: %v", user.Email, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to send verification email"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "We've sent a new verification link to " + user.Email + ".",
+	})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Square signs each notification with HMAC-SHA256 over the subscription's
+// notification URL followed by the raw body, keyed by the subscription's
+// signature key, and sends the base64 digest in this header.
+const squareSignatureHeader = "x-square-hmacsha256-signature"
+
+// maxWebhookBodyBytes bounds the notification body we are willing to read
+const maxWebhookBodyBytes = 1 << 20
+
+// squareWebhookEvent is the envelope of a Square webhook notification
+type squareWebhookEvent struct {
+	EventID string `json:"event_id"`
+	Type    string `json:"type"`
+	Data    struct {
+		Type   string `json:"type"`
+		ID     string `json:"id"`
+		Object struct {
+			Payment *squarePayment `json:"payment"`
+			Refund  *squareRefund  `json:"refund"`
+		} `json:"object"`
+	} `json:"data"`
+}
+
+// verifySquareSignature checks a notification's signature header
+func verifySquareSignature(signatureKey, notificationURL string, body []byte, signature string) bool {
+	mac := hmac.New(sha256.New, []byte(signatureKey))
+	mac.Write([]byte(notificationURL))
+	mac.Write(body)
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// squareWebhookHandler receives Square notifications at /webhooks/square.
+// Events are stored by event ID in the same transaction that applies them,
+// so a redelivered event is acknowledged without being applied twice and a
+// failed one is rolled back for Square to retry.
+func squareWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	signatureKey := os.Getenv("SQUARE_WEBHOOK_SIGNATURE_KEY")
+	notificationURL := os.Getenv("SQUARE_WEBHOOK_URL")
+	if signatureKey == "" || notificationURL == "" {
+		log.Printf("Square webhook received but SQUARE_WEBHOOK_SIGNATURE_KEY or SQUARE_WEBHOOK_URL is not set")
+		http.Error(w, "Webhooks not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodyBytes))
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if !verifySquareSignature(signatureKey, notificationURL, body, r.Header.Get(squareSignatureHeader)) {
+		log.Printf("Rejected Square webhook with invalid signature")
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var event squareWebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil || event.EventID == "" {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		// Record the event first; a redelivery finds it already stored
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&WebhookEvent{
+			ID:       event.EventID,
+			Provider: "square",
+			Type:     event.Type,
+			Payload:  string(body),
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			log.Printf("Ignoring duplicate Square webhook %s", event.EventID)
+			return nil
+		}
+
+		return applySquareEvent(tx, &event)
+	})
+	if err != nil {
+		log.Printf("Failed to process Square webhook %s (%s): %v", event.EventID, event.Type, err)
+		http.Error(w, "Failed to process event", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// applySquareEvent updates orders from a payment or refund notification.
+// Other event types are stored but otherwise ignored.
+func applySquareEvent(tx *gorm.DB, event *squareWebhookEvent) error {
+	switch event.Type {
+	case "payment.updated":
+		if payment := event.Data.Object.Payment; payment != nil {
+			return applyPaymentUpdate(tx, payment)
+		}
+	case "refund.created", "refund.updated":
+		if refund := event.Data.Object.Refund; refund != nil {
+			return applyRefundUpdate(tx, refund)
+		}
+	}
+	return nil
+}
+
+// findOrderForPayment locks the order paid with paymentID. It returns nil
+// when the payment does not belong to an order, e.g. an authorization that
+// was voided after the order failed to save.
+func findOrderForPayment(tx *gorm.DB, paymentID string) (*Order, error) {
+	var order Order
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("payment_id = ?", paymentID).
+		First(&order).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("Webhook for payment %s does not match any order", paymentID)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// applyPaymentUpdate records the processor's payment status on the order
+func applyPaymentUpdate(tx *gorm.DB, payment *squarePayment) error {
+	order, err := findOrderForPayment(tx, payment.ID)
+	if order == nil || err != nil {
+		return err
+	}
+
+	// Notifications can arrive out of order; never move a settled payment
+	// back to APPROVED
+	if payment.Status == PaymentStatusApproved && order.PaymentStatus != "" && order.PaymentStatus != PaymentStatusApproved {
+		return nil
+	}
+
+	order.PaymentStatus = payment.Status
+	return saveReconciledOrder(tx, order, nil, "Square payment "+payment.Status)
+}
+
+// applyRefundUpdate upserts the refund and recomputes the refunded total.
+// A refund the processor rejects gives its order lines back so they can be
+// refunded again.
+func applyRefundUpdate(tx *gorm.DB, update *squareRefund) error {
+	order, err := findOrderForPayment(tx, update.PaymentID)
+	if order == nil || err != nil {
+		return err
+	}
+
+	var refund Refund
+	err = tx.Preload("Items").Where("provider_refund_id = ?", update.ID).First(&refund).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// A refund we submitted whose provider ID is not saved yet
+		err = tx.Preload("Items").
+			Where("order_id = ? AND provider_refund_id IS NULL AND status = ? AND amount = ?",
+				order.ID, RefundStatusPending, update.AmountMoney.Amount).
+			Order("created_at").
+			First(&refund).Error
+		if err == nil {
+			refund.ProviderRefundID = &update.ID
+			if err := tx.Model(&refund).Update("provider_refund_id", update.ID).Error; err != nil {
+				return err
+			}
+		}
+	}
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		refund = Refund{
+			OrderID:          order.ID,
+			ProviderRefundID: &update.ID,
+			Amount:           update.AmountMoney.Amount,
+			Status:           update.Status,
+		}
+		if err := tx.Create(&refund).Error; err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case refund.Status == RefundStatusPending && update.Status != RefundStatusPending:
+		// Only pending refunds change; later statuses are final
+		if err := tx.Model(&refund).Update("status", update.Status).Error; err != nil {
+			return err
+		}
+		if refundFailed(update.Status) {
+			if err := applyRefundItems(tx, &refund, -1); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := updateRefundedAmount(tx, order); err != nil {
+		return err
+	}
+	return saveReconciledOrder(tx, order, nil, "Square refund "+update.Status)
+}
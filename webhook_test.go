@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+const (
+	testWebhookKey = "test-signature-key"
+	testWebhookURL = "https://shop.example.com/webhooks/square"
+
+	// testPaymentID is the Square payment in the recorded notifications
+	testPaymentID = "hYy9pRFVxpDsO1FB05SunFWUe9JZY"
+)
+
+// squareNotification reads a recorded Square webhook body from testdata
+func squareNotification(t *testing.T, name string) []byte {
+	t.Helper()
+
+	body, err := os.ReadFile(filepath.Join("testdata", "square", name))
+	if err != nil {
+		t.Fatalf("read notification: %v", err)
+	}
+	return body
+}
+
+// signSquare signs a body the way Square does for testWebhookURL
+func signSquare(key string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(testWebhookURL))
+	mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// deliverSquareWebhook posts a notification with the given signature
+// header, omitted when empty, and returns the response status
+func deliverSquareWebhook(t *testing.T, body []byte, signature string) int {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/webhooks/square", bytes.NewReader(body))
+	if signature != "" {
+		req.Header.Set(squareSignatureHeader, signature)
+	}
+	rec := httptest.NewRecorder()
+	squareWebhookHandler(rec, req)
+	return rec.Code
+}
+
+func configureSquareWebhooks(t *testing.T) {
+	t.Setenv("SQUARE_WEBHOOK_SIGNATURE_KEY", testWebhookKey)
+	t.Setenv("SQUARE_WEBHOOK_URL", testWebhookURL)
+}
+
+// createTestOrder records an order for the payment in the notifications
+func createTestOrder(t *testing.T, status, paymentStatus string, total int64) *Order {
+	t.Helper()
+
+	user := createTestUser(t)
+	order := &Order{
+		ID:            uuid.New().String(),
+		UserID:        user.ID,
+		Total:         total,
+		Status:        status,
+		PaymentID:     testPaymentID,
+		PaymentStatus: paymentStatus,
+	}
+	if fulfillmentRank(status) > 0 {
+		order.FulfillmentStatus = status
+	}
+	if err := DB.Create(order).Error; err != nil {
+		t.Fatalf("create order: %v", err)
+	}
+	return order
+}
+
+func reloadOrder(t *testing.T, id string) Order {
+	t.Helper()
+
+	var order Order
+	if err := DB.First(&order, "id = ?", id).Error; err != nil {
+		t.Fatalf("load order: %v", err)
+	}
+	return order
+}
+
+func TestVerifySquareSignature(t *testing.T) {
+	body := squareNotification(t, "payment_updated.json")
+
+	// Computed independently with Python's hmac module
+	const recorded = "edg5hIQ+yTdrAZE9dWdFFYjBC52gcaZGlApTnttNJbg="
+	if !verifySquareSignature(testWebhookKey, testWebhookURL, body, recorded) {
+		t.Error("recorded signature rejected")
+	}
+	if verifySquareSignature(testWebhookKey, "https://other.example.com/webhooks/square", body, recorded) {
+		t.Error("signature accepted for a different notification URL")
+	}
+}
+
+func TestSquareWebhookRejectsBadSignature(t *testing.T) {
+	configureSquareWebhooks(t)
+	body := squareNotification(t, "payment_updated.json")
+
+	tests := []struct {
+		name      string
+		body      []byte
+		signature string
+	}{
+		{"missing", body, ""},
+		{"not base64", body, "not-a-signature"},
+		{"wrong key", body, signSquare("some-other-key", body)},
+		{"body changed after signing", bytes.Replace(body, []byte(`"COMPLETED"`), []byte(`"CANCELED"`), 1), signSquare(testWebhookKey, body)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := deliverSquareWebhook(t, tt.body, tt.signature); got != http.StatusUnauthorized {
+				t.Errorf("status = %d, want %d", got, http.StatusUnauthorized)
+			}
+		})
+	}
+}
+
+func TestSquareWebhookUpdatesOrder(t *testing.T) {
+	tests := []struct {
+		name              string
+		notification      string
+		status            string // order before the notification
+		paymentStatus     string
+		total             int64
+		wantStatus        string
+		wantPaymentStatus string
+		wantRefunded      int64
+	}{
+		{
+			name:         "payment completed keeps the order paid",
+			notification: "payment_updated.json",
+			status:       OrderStatusPaid, paymentStatus: PaymentStatusApproved, total: 4999,
+			wantStatus: OrderStatusPaid, wantPaymentStatus: PaymentStatusCompleted,
+		},
+		{
+			name:         "payment canceled cancels the order",
+			notification: "payment_updated_canceled.json",
+			status:       OrderStatusPending, paymentStatus: PaymentStatusApproved, total: 4999,
+			wantStatus: OrderStatusCancelled, wantPaymentStatus: PaymentStatusCanceled,
+		},
+		{
+			name:         "refund of part of the total",
+			notification: "refund_updated.json",
+			status:       OrderStatusShipped, paymentStatus: PaymentStatusCompleted, total: 4999,
+			wantStatus: OrderStatusPartiallyRefunded, wantPaymentStatus: PaymentStatusCompleted, wantRefunded: 1500,
+		},
+		{
+			name:         "refund of the whole total",
+			notification: "refund_updated.json",
+			status:       OrderStatusPaid, paymentStatus: PaymentStatusCompleted, total: 1500,
+			wantStatus: OrderStatusRefunded, wantPaymentStatus: PaymentStatusCompleted, wantRefunded: 1500,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestDatabase(t)
+			configureSquareWebhooks(t)
+			order := createTestOrder(t, tt.status, tt.paymentStatus, tt.total)
+
+			body := squareNotification(t, tt.notification)
+			if got := deliverSquareWebhook(t, body, signSquare(testWebhookKey, body)); got != http.StatusOK {
+				t.Fatalf("status = %d, want %d", got, http.StatusOK)
+			}
+
+			saved := reloadOrder(t, order.ID)
+			if saved.Status != tt.wantStatus {
+				t.Errorf("order status = %s, want %s", saved.Status, tt.wantStatus)
+			}
+			if saved.PaymentStatus != tt.wantPaymentStatus {
+				t.Errorf("payment status = %s, want %s", saved.PaymentStatus, tt.wantPaymentStatus)
+			}
+			if saved.RefundedAmount != tt.wantRefunded {
+				t.Errorf("refunded amount = %d, want %d", saved.RefundedAmount, tt.wantRefunded)
+			}
+		})
+	}
+}
+
+func TestSquareWebhookIgnoresReplayedEvent(t *testing.T) {
+	useTestDatabase(t)
+	configureSquareWebhooks(t)
+	order := createTestOrder(t, OrderStatusPending, PaymentStatusApproved, 4999)
+
+	body := squareNotification(t, "payment_updated_canceled.json")
+	signature := signSquare(testWebhookKey, body)
+	if got := deliverSquareWebhook(t, body, signature); got != http.StatusOK {
+		t.Fatalf("first delivery status = %d, want %d", got, http.StatusOK)
+	}
+	if saved := reloadOrder(t, order.ID); saved.Status != OrderStatusCancelled {
+		t.Fatalf("order status after first delivery = %s, want %s", saved.Status, OrderStatusCancelled)
+	}
+
+	// Put the order back; applying the event again would cancel it again
+	err := DB.Model(&Order{}).Where("id = ?", order.ID).Updates(map[string]interface{}{
+		"status":         OrderStatusPending,
+		"payment_status": PaymentStatusApproved,
+	}).Error
+	if err != nil {
+		t.Fatalf("reset order: %v", err)
+	}
+
+	if got := deliverSquareWebhook(t, body, signature); got != http.StatusOK {
+		t.Fatalf("replay status = %d, want %d", got, http.StatusOK)
+	}
+	saved := reloadOrder(t, order.ID)
+	if saved.Status != OrderStatusPending || saved.PaymentStatus != PaymentStatusApproved {
+		t.Errorf("replay changed the order to %s with payment %s", saved.Status, saved.PaymentStatus)
+	}
+
+	var events int64
+	if err := DB.Model(&WebhookEvent{}).Count(&events).Error; err != nil {
+		t.Fatalf("count events: %v", err)
+	}
+	if events != 1 {
+		t.Errorf("%d webhook events stored, want 1", events)
+	}
+}